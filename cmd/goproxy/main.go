@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	logpkg "log"
 	"net"
-	urlpkg "net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,20 +21,159 @@ import (
 	"github.com/lexesjan/go-web-proxy-server/pkg/httpclient"
 	"github.com/lexesjan/go-web-proxy-server/pkg/log"
 	"github.com/lexesjan/go-web-proxy-server/pkg/metrics"
+	"github.com/lexesjan/go-web-proxy-server/pkg/redis"
 )
 
+// proxy holds the state shared between all client connections.
+type proxy struct {
+	cache         *cache.Cache
+	client        *httpclient.Client
+	blockList     *sync.Map
+	metrics       *metrics.Metrics
+	idleTimeout   time.Duration
+	maxRequests   int
+	maxUploadSize int64
+	// via is the pseudonym of the proxy added to the Via header. An empty via
+	// adds no Via header.
+	via           string
+	forwarded     bool
+	xForwardedFor bool
+	staleIfError  time.Duration
+	// revalidating holds the cache entries being revalidated in the background.
+	revalidating *sync.Map
+	// purgeAllow holds the client networks allowed to send PURGE requests.
+	purgeAllow []*net.IPNet
+}
+
 func main() {
-	args := os.Args
-	if len(args) != 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s <port number>\n", args[0])
+	maxCacheSize := flag.Int64(
+		"max-cache-size",
+		256<<20,
+		"maximum size in bytes of all cached responses, 0 for no limit",
+	)
+	maxEntrySize := flag.Int64(
+		"max-entry-size",
+		64<<20,
+		"maximum size in bytes of a response body which will be cached",
+	)
+	cacheDir := flag.String(
+		"cache-dir",
+		"",
+		"directory cached responses are kept in across restarts, empty to only cache in memory",
+	)
+	maxDiskCacheSize := flag.Int64(
+		"max-disk-cache-size",
+		1<<30,
+		"maximum size in bytes of the files in the cache directory, 0 for no limit",
+	)
+	redisAddr := flag.String(
+		"redis-addr",
+		"",
+		"address of a key-value server speaking the Redis protocol to share the cache with other proxies, empty to cache locally",
+	)
+	redisTimeout := flag.Duration(
+		"redis-timeout",
+		2*time.Second,
+		"time allowed to connect to the Redis server and for each command, 0 for no timeout",
+	)
+	idleTimeout := flag.Duration(
+		"idle-timeout",
+		60*time.Second,
+		"time a client connection is kept open waiting for the next request, 0 for no timeout",
+	)
+	maxRequests := flag.Int(
+		"max-requests",
+		100,
+		"maximum number of requests served on a client connection, 0 for no limit",
+	)
+	maxUploadSize := flag.Int64(
+		"max-upload-size",
+		0,
+		"maximum size in bytes of a request body forwarded to a host server, 0 for no limit",
+	)
+	via := flag.String(
+		"via",
+		"goproxy",
+		"pseudonym of the proxy added to the Via header, empty to omit the Via header",
+	)
+	forwarded := flag.Bool(
+		"forwarded",
+		true,
+		"add the client IP address to the Forwarded header of requests",
+	)
+	xForwardedFor := flag.Bool(
+		"x-forwarded-for",
+		true,
+		"add the client IP address to the X-Forwarded-For header of requests",
+	)
+	staleIfError := flag.Duration(
+		"stale-if-error",
+		0,
+		"time a stale cached response is served for when the host server fails, regardless of Cache-Control",
+	)
+	purgeAllow := flag.String(
+		"purge-allow",
+		"127.0.0.1,::1",
+		"comma separated client IP addresses and networks allowed to send PURGE requests, empty to allow none",
+	)
+	rulesFile := flag.String(
+		"rules-file",
+		"",
+		"file of cache rules overriding how the responses of hosts and paths are cached",
+	)
+	offline := flag.Bool(
+		"offline",
+		false,
+		"start offline, only answering requests from the cache",
+	)
+	maxConnsPerHost := flag.Int(
+		"upstream-max-conns-per-host",
+		0,
+		"maximum number of connections to a host server, 0 for no limit",
+	)
+	maxIdleConnsPerHost := flag.Int(
+		"upstream-max-idle-per-host",
+		8,
+		"maximum number of idle connections kept open to a host server, 0 for no limit",
+	)
+	maxIdleConns := flag.Int(
+		"upstream-max-idle",
+		100,
+		"maximum number of idle connections kept open to all host servers, 0 for no limit",
+	)
+	upstreamIdleTimeout := flag.Duration(
+		"upstream-idle-timeout",
+		90*time.Second,
+		"time an idle connection to a host server is kept open, 0 for no timeout",
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <port number>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		return
 	}
 
-	port, err := strconv.Atoi(args[1])
-	if err != nil || port < 0 && port > 65535 {
-		fmt.Fprintf(os.Stderr, "error: %s is not a valid port number\n", err)
+	port, err := strconv.Atoi(flag.Arg(0))
+	if err != nil || port < 0 || port > 65535 {
+		fmt.Fprintf(os.Stderr, "error: %q is not a valid port number\n", flag.Arg(0))
 		return
 	}
+	purgeAllowNets, err := parseIPNets(*purgeAllow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: -purge-allow: %s\n", err)
+		return
+	}
+	rules := []*cache.Rule{}
+	if *rulesFile != "" {
+		rules, err = readRulesFile(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -rules-file: %s\n", err)
+			return
+		}
+	}
 
 	lc, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -39,11 +182,50 @@ func main() {
 	defer lc.Close()
 	log.ProxyListen("localhost", port)
 
-	cache := cache.NewCache()
-	var blockList sync.Map
 	metrics := metrics.NewMetrics()
+	var storage cache.Storage = cache.NewMemoryStorage(
+		*maxCacheSize,
+		metrics.AddEviction,
+	)
+	if *cacheDir != "" {
+		diskStorage, err := cache.NewDiskStorage(*cacheDir, *maxDiskCacheSize)
+		if err != nil {
+			logpkg.Fatal(err)
+		}
+		storage = cache.NewTieredStorage(storage, diskStorage)
+	}
+	// A shared cache replaces the local cache.
+	if *redisAddr != "" {
+		storage = cache.NewRedisStorage(redis.NewClient(*redisAddr, *redisTimeout))
+	}
+	proxy := &proxy{
+		cache: cache.NewCache(storage, *maxEntrySize),
+		client: httpclient.NewClient(&httpclient.PoolOptions{
+			MaxConnsPerHost:     *maxConnsPerHost,
+			MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+			MaxIdleConns:        *maxIdleConns,
+			IdleTimeout:         *upstreamIdleTimeout,
+		}),
+		blockList:     &sync.Map{},
+		metrics:       metrics,
+		idleTimeout:   *idleTimeout,
+		maxRequests:   *maxRequests,
+		maxUploadSize: *maxUploadSize,
+		via:           *via,
+		forwarded:     *forwarded,
+		xForwardedFor: *xForwardedFor,
+		staleIfError:  *staleIfError,
+		revalidating:  &sync.Map{},
+		purgeAllow:    purgeAllowNets,
+	}
 
-	go commandline.Dispatcher(&blockList, metrics)
+	for _, rule := range rules {
+		proxy.cache.AddRule(rule)
+	}
+	proxy.cache.SetOffline(*offline)
+	proxy.cache.SetStaleIfError(*staleIfError)
+
+	go commandline.Dispatcher(proxy.blockList, proxy.cache, proxy.metrics)
 
 	for {
 		conn, err := lc.Accept()
@@ -51,69 +233,264 @@ func main() {
 			logpkg.Fatal(err)
 		}
 
-		go handleConnection(conn, cache, &blockList, metrics)
+		go proxy.handleConnection(conn)
 	}
 }
 
-func handleConnection(
-	conn net.Conn,
-	cache *cache.Cache,
-	blockList *sync.Map,
-	metrics *metrics.Metrics,
-) {
-	defer conn.Close()
+// clientConn is a connection with a client which can serve multiple requests.
+type clientConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	keepAlive bool
+}
 
-	req, err := http.NewRequest(conn)
-	if err != nil {
-		log.ProxyError(err)
-		return
+// writeResponse writes the response to the client. The Connection header and
+// the framing of the body are set so that the connection can persist after the
+// response if the client wants it to.
+func (conn *clientConn) writeResponse(
+	req *http.Request,
+	resp *http.Response,
+) (n int64, err error) {
+	http11 := req.HTTPVer == "HTTP/1.1"
+	if !resp.Delimited() {
+		if http11 {
+			resp.Headers.Set("Transfer-Encoding", "chunked")
+		} else {
+			conn.keepAlive = false
+		}
+	} else if resp.Headers.Chunked() && !http11 {
+		// HTTP/1.0 clients do not understand chunked bodies.
+		resp.Headers.Del("Transfer-Encoding")
+		resp.Headers.Del("Content-Length")
+		conn.keepAlive = false
 	}
 
-	host := req.Headers["Host"]
-	// Handle website blocking.
-	if blocked, ok := blockList.Load(host); ok {
-		if blocked == true {
-			forbiddenMessage := fmt.Sprintf("Blocked %q by proxy\n", host)
-			respHeaders := map[string]string{
-				"Content-Length": strconv.Itoa(len(forbiddenMessage)),
-			}
-			resp := &http.Response{
-				StatusCode:        403,
-				StatusDescription: "Forbidden",
-				Headers:           respHeaders,
-				Body:              forbiddenMessage,
-				HTTPVer:           req.HTTPVer,
+	// Responses to HEAD requests never have a body even if they were cached
+	// from a GET request.
+	if req.Method == "HEAD" {
+		resp.OmitBody()
+	}
+
+	if conn.keepAlive {
+		resp.Headers.Set("Connection", "keep-alive")
+	} else {
+		resp.Headers.Set("Connection", "close")
+	}
+
+	return resp.WriteTo(conn)
+}
+
+// newMessageResponse returns a response generated by the proxy with a plain
+// text message as the body.
+func newMessageResponse(
+	statusCode int,
+	statusDescription string,
+	httpVer string,
+	message string,
+) (resp *http.Response) {
+	resp = &http.Response{
+		StatusCode:        statusCode,
+		StatusDescription: statusDescription,
+		Headers: http.Headers{
+			{Name: "Content-Type", Value: "text/plain; charset=utf-8"},
+			{Name: "Content-Length", Value: strconv.Itoa(len(message))},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader(message)),
+		HTTPVer: httpVer,
+	}
+
+	return resp
+}
+
+func (proxy *proxy) handleConnection(netConn net.Conn) {
+	defer netConn.Close()
+
+	conn := &clientConn{
+		Conn:      netConn,
+		reader:    bufio.NewReader(netConn),
+		keepAlive: true,
+	}
+	for requests := 1; conn.keepAlive; requests++ {
+		if proxy.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(proxy.idleTimeout))
+		}
+		req, err := http.NewRequest(conn.reader)
+		if err != nil {
+			// The client closed the connection or it was idle for too long.
+			if netErr, ok := err.(net.Error); err == io.EOF || ok && netErr.Timeout() {
+				return
 			}
-			fmt.Fprint(conn, resp)
+			log.ProxyError(err)
+			resp := newMessageResponse(
+				400,
+				"Bad Request",
+				"HTTP/1.1",
+				"Malformed request\n",
+			)
+			resp.Headers.Set("Connection", "close")
+			resp.WriteTo(conn)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn.keepAlive = req.KeepAlive() &&
+			(proxy.maxRequests == 0 || requests < proxy.maxRequests)
+
+		host := req.Headers.Get("Host")
+		// Handle website blocking.
+		if blocked, ok := proxy.blockList.Load(host); ok && blocked == true {
+			resp := newMessageResponse(
+				403,
+				"Forbidden",
+				req.HTTPVer,
+				fmt.Sprintf("Blocked %q by proxy\n", host),
+			)
+			_, err = conn.writeResponse(req, resp)
 			log.ProxyBlock(host)
+		} else if req.Form == http.AsteriskForm {
+			// The client is asking about the proxy itself.
+			resp := newMessageResponse(200, "OK", req.HTTPVer, "")
+			resp.Headers.Set(
+				"Allow",
+				"GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE, CONNECT",
+			)
+			_, err = conn.writeResponse(req, resp)
+		} else if req.Method == "PURGE" {
+			// Handle a request to remove a response from the cache.
+			err = proxy.handlePurge(conn, req)
+		} else if req.Method == "CONNECT" && proxy.cache.Offline() {
+			// Tunnels can't be answered from the cache.
+			resp := newMessageResponse(
+				504,
+				"Gateway Timeout",
+				req.HTTPVer,
+				fmt.Sprintf("The proxy is offline and can't connect to %q\n", req.Target),
+			)
+			_, err = conn.writeResponse(req, resp)
+		} else if req.Method == "CONNECT" {
+			// Handle HTTPS request. The connection becomes a tunnel.
+			err = handleHTTPS(conn, req)
+			conn.keepAlive = false
+		} else {
+			// Handle HTTP request.
+			err = proxy.handleHTTP(conn, req)
+		}
+		if err != nil {
+			log.ProxyError(err)
 			return
 		}
+
+		// Discard the rest of the request body so the next request can be read.
+		if req.Body != nil {
+			_, err = io.Copy(ioutil.Discard, req.Body)
+			if err != nil {
+				return
+			}
+		}
 	}
+}
+
+// readRulesFile reads the cache rules in the file.
+func readRulesFile(path string) (rules []*cache.Rule, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return []*cache.Rule{}, err
+	}
+	defer file.Close()
 
-	// Handle HTTPS request.
-	if req.Method == "CONNECT" {
-		err := handleHTTPS(conn, req)
+	return cache.ReadRules(file)
+}
+
+// parseIPNets parses a comma separated list of IP addresses and networks in
+// CIDR notation. An IP address is a network holding only that address.
+func parseIPNets(list string) (ipNets []*net.IPNet, err error) {
+	ipNets = []*net.IPNet{}
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
 		if err != nil {
-			log.ProxyError(err)
+			return []*net.IPNet{}, fmt.Errorf("%q is not an IP address or network", value)
 		}
-		return
+		ipNets = append(ipNets, ipNet)
 	}
 
-	// Handle HTTP request.
-	err = handleHTTP(conn, req, cache, metrics)
+	return ipNets, nil
+}
+
+// purgeAllowed reports whether the client is allowed to send PURGE requests.
+func (proxy *proxy) purgeAllowed(conn *clientConn) bool {
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		log.ProxyError(err)
+		return false
+	}
+	ip := net.ParseIP(clientIP)
+	for _, ipNet := range proxy.purgeAllow {
+		if ipNet.Contains(ip) {
+			return true
+		}
 	}
+
+	return false
 }
 
-func handleHTTPS(conn net.Conn, req *http.Request) (err error) {
-	log.ProxyHTTPSRequest(req)
-	rawurl := req.Headers["Host"]
-	url, err := urlpkg.Parse(fmt.Sprintf("https://%s/", rawurl))
+// handlePurge removes every cached variant of the request URL. The number and
+// size of the responses freed are sent to the client. Clients which are not
+// allowed to purge the cache are forbidden.
+func (proxy *proxy) handlePurge(conn *clientConn, req *http.Request) (err error) {
+	startTime := time.Now()
+	reqURL := req.URL()
+	if !proxy.purgeAllowed(conn) {
+		resp := newMessageResponse(
+			403,
+			"Forbidden",
+			req.HTTPVer,
+			"Purging the cache is not allowed\n",
+		)
+		_, err = conn.writeResponse(req, resp)
+		log.ProxyHTTPResponse(req, resp, 0, time.Since(startTime), false)
+		return err
+	}
+
+	freed, err := proxy.cache.Purge(reqURL)
 	if err != nil {
+		log.ProxyError(err)
+		resp := newMessageResponse(
+			500,
+			"Internal Server Error",
+			req.HTTPVer,
+			fmt.Sprintf("Failed to purge %q\n", reqURL),
+		)
+		_, err = conn.writeResponse(req, resp)
 		return err
 	}
-	remote, err := net.Dial("tcp", url.Host)
+	log.ProxyCachePurge(reqURL, freed.Entries, freed.Size)
+
+	message := fmt.Sprintf("Purged %d entries, %d bytes\n", freed.Entries, freed.Size)
+	resp := newMessageResponse(200, "OK", req.HTTPVer, message)
+	if freed.Entries == 0 {
+		resp = newMessageResponse(404, "Not Found", req.HTTPVer, message)
+	}
+	_, err = conn.writeResponse(req, resp)
+	log.ProxyHTTPResponse(req, resp, 0, time.Since(startTime), false)
+
+	return err
+}
+
+func handleHTTPS(conn *clientConn, req *http.Request) (err error) {
+	log.ProxyHTTPSRequest(req)
+	remote, err := net.Dial("tcp", req.Target)
 	if err != nil {
 		return err
 	}
@@ -122,69 +499,481 @@ func handleHTTPS(conn net.Conn, req *http.Request) (err error) {
 	fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n")
 	fmt.Fprint(conn, "\r\n")
 
-	// Tunnel between client and server.
-	go io.Copy(remote, conn)
+	// Tunnel between client and server. Data the client sent after the CONNECT
+	// request may already be buffered in the reader.
+	go io.Copy(remote, conn.reader)
 	io.Copy(conn, remote)
 
 	return nil
 }
 
-func handleHTTP(
-	conn net.Conn,
+// forwardRequestHeaders returns the headers of a request to be sent to the
+// host server. Hop-by-hop headers are removed and the proxy is added to the
+// Via, Forwarded and X-Forwarded-For headers if enabled.
+func (proxy *proxy) forwardRequestHeaders(
+	conn *clientConn,
 	req *http.Request,
-	cache *cache.Cache,
-	metrics *metrics.Metrics,
-) (err error) {
+) (headers http.Headers) {
+	headers = req.Headers.Clone()
+	headers.RemoveHopByHop()
+
+	if proxy.via != "" {
+		headers.Add("Via", viaValue(req.HTTPVer, proxy.via))
+	}
+
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return headers
+	}
+	if proxy.forwarded {
+		forwardedFor := clientIP
+		// IPv6 addresses must be quoted and bracketed.
+		if strings.Contains(clientIP, ":") {
+			forwardedFor = fmt.Sprintf("\"[%s]\"", clientIP)
+		}
+		headers.Add(
+			"Forwarded",
+			fmt.Sprintf(
+				"for=%s;host=%q;proto=http",
+				forwardedFor,
+				req.Headers.Get("Host"),
+			),
+		)
+	}
+	if proxy.xForwardedFor {
+		headers.Add("X-Forwarded-For", clientIP)
+	}
+
+	return headers
+}
+
+// forwardResponseHeaders removes the hop-by-hop headers from a response sent
+// by the host server and adds the proxy to the Via header if enabled.
+func (proxy *proxy) forwardResponseHeaders(resp *http.Response) {
+	resp.Headers.RemoveHopByHop()
+	if proxy.via != "" {
+		resp.Headers.Add("Via", viaValue(resp.HTTPVer, proxy.via))
+	}
+}
+
+// viaValue returns the Via header value of the proxy for a message received
+// with the HTTP version specified e.g. 1.1 goproxy
+func viaValue(httpVer string, pseudonym string) (via string) {
+	return fmt.Sprintf("%s %s", strings.TrimPrefix(httpVer, "HTTP/"), pseudonym)
+}
+
+func (proxy *proxy) handleHTTP(conn *clientConn, req *http.Request) (err error) {
 	startTime := time.Now()
-	host := req.Headers["Host"]
-	reqOptions := &httpclient.Options{
-		Method:  req.Method,
-		HTTPVer: req.HTTPVer,
-		Headers: req.Headers,
+	if req.Body != nil && proxy.maxUploadSize > 0 {
+		if req.ContentLength() > proxy.maxUploadSize {
+			return proxy.writePayloadTooLarge(conn, req)
+		}
+		req.Body = http.MaxBytesReader(req.Body, proxy.maxUploadSize)
+	}
+	reqURL := req.URL()
+	// Only GET responses are cached and they can also answer HEAD requests.
+	cachedEntry, cacheFound := &cache.Entry{}, false
+	if req.Method == "GET" || req.Method == "HEAD" {
+		cachedEntry, cacheFound = proxy.cache.Get(reqURL, req.Headers)
+	}
+	// Only cached responses are served while the proxy is offline.
+	if proxy.cache.Offline() {
+		return proxy.serveOffline(conn, req, cachedEntry, cacheFound, startTime)
 	}
-	reqURL := fmt.Sprintf("http://%s%s", host, req.Path)
-	cachedEntry, cacheFound := cache.Get(reqURL)
 	if cacheFound {
-		if cachedEntry.Stale {
-			currTimeFormatted := time.Now().In(time.UTC).Format(http.TimeFormat)
-			req.Headers["If-Modified-Since"] = currTimeFormatted
-		} else {
+		usable, stale := cachedEntry.Satisfies(req.Headers, startTime)
+		if usable && stale {
+			return proxy.serveStale(
+				conn,
+				req,
+				cachedEntry,
+				startTime,
+				"max-stale",
+				`110 - "Response is Stale"`,
+			)
+		} else if usable {
 			// Return cached response as it is not stale
-			fmt.Fprint(conn, cachedEntry.Response)
+			cachedResp, err := proxy.writeCachedResponse(conn, req, cachedEntry)
+			if err != nil {
+				return err
+			}
 			duration := time.Since(startTime)
-			log.ProxyHTTPResponse(req, &http.Response{}, duration, true)
-			metrics.AddMetrics(reqURL, cachedEntry, duration, 0)
-			return
+			log.ProxyHTTPResponse(req, cachedResp, 0, duration, true)
+			proxy.metrics.AddMetrics(reqURL, cachedEntry, duration, 0)
+			proxy.cache.Hit(reqURL, cachedEntry)
+			return nil
+		}
+	}
+
+	// The client does not want the request forwarded to the host server.
+	if cache.OnlyIfCached(req.Headers) {
+		resp := newMessageResponse(
+			504,
+			"Gateway Timeout",
+			req.HTTPVer,
+			"No cached response available\n",
+		)
+		_, err = conn.writeResponse(req, resp)
+		proxy.cache.Miss(reqURL)
+		return err
+	}
+
+	// The validators of the client are kept in the request headers so that they
+	// can be checked against the cached response.
+	headers := proxy.forwardRequestHeaders(conn, req)
+	if cacheFound {
+		// Ask the host server whether the cached response has changed.
+		headers.Del("If-None-Match")
+		headers.Del("If-Modified-Since")
+		for _, header := range cachedEntry.ConditionalHeaders() {
+			headers.Add(header.Name, header.Value)
+		}
+
+		if req.Body == nil &&
+			cachedEntry.StaleWhileRevalidate(req.Headers, startTime) {
+			go proxy.revalidate(
+				reqURL,
+				req.Headers.Clone(),
+				headers,
+				cachedEntry,
+			)
+			return proxy.serveStale(
+				conn,
+				req,
+				cachedEntry,
+				startTime,
+				"stale-while-revalidate",
+				`110 - "Response is Stale"`,
+			)
+		}
+	}
+
+	// The client may wait for permission before sending the body.
+	if req.Body != nil &&
+		strings.EqualFold(req.Headers.Get("Expect"), "100-continue") {
+		req.Headers.Del("Expect")
+		headers.Del("Expect")
+		fmt.Fprint(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+
+	// Concurrent requests for the same uncached response share one request to
+	// the host server. Requests for ranges are forwarded on their own.
+	var flight *cache.Flight
+	if !cacheFound && req.Method == "GET" && req.Body == nil &&
+		!req.Headers.Has("Range") {
+		joined, leader := proxy.cache.Join(reqURL, req.Method, req.Headers)
+		if leader {
+			flight = joined
+		} else if resp, ok := joined.Wait(req.Headers); ok {
+			return proxy.serveCoalesced(conn, req, resp, startTime)
 		}
 	}
 
 	// Response not in cache or validate cache
-	resp, err := httpclient.Request(reqURL, reqOptions)
+	reqOptions := &httpclient.Options{
+		Method:  req.Method,
+		Headers: headers,
+		Body:    req.Body,
+	}
+	resp, err := proxy.client.Request(reqURL, reqOptions)
 	if err != nil {
+		if flight != nil {
+			flight.Fail(err)
+		}
+		// Chunked uploads are only found to be too large while they are sent.
+		// The request to the host server is abandoned along with its connection.
+		if errors.Is(err, http.ErrBodyTooLarge) {
+			return proxy.writePayloadTooLarge(conn, req)
+		}
+		// Serve the stale copy rather than failing.
+		if cacheFound && cachedEntry.StaleIfError(time.Now(), 0, proxy.staleIfError) {
+			log.ProxyError(err)
+			return proxy.serveStale(
+				conn,
+				req,
+				cachedEntry,
+				startTime,
+				"stale-if-error",
+				`110 - "Response is Stale"`,
+				`111 - "Revalidation Failed"`,
+			)
+		}
 		return err
 	}
+	defer resp.Body.Close()
+	if flight != nil {
+		defer flight.Land()
+	}
+	proxy.forwardResponseHeaders(resp)
+	if cacheFound {
+		log.ProxyCacheRevalidate(
+			reqURL,
+			headers.Get("If-None-Match"),
+			headers.Get("If-Modified-Since"),
+			resp.StatusCode,
+		)
+	}
+
+	if cacheFound &&
+		cachedEntry.StaleIfError(time.Now(), resp.StatusCode, proxy.staleIfError) {
+		return proxy.serveStale(
+			conn,
+			req,
+			cachedEntry,
+			startTime,
+			"stale-if-error",
+			`110 - "Response is Stale"`,
+			`111 - "Revalidation Failed"`,
+		)
+	}
 
 	// Cached response is still valid
 	if cacheFound && resp.StatusCode == 304 {
-		fmt.Fprint(conn, cachedEntry.Response)
-		duration := time.Since(startTime)
-		cachedEntry.ResetTimer(reqURL, resp.Headers.CacheControl())
+		cachedEntry = proxy.cache.Revalidate(cachedEntry, resp, startTime)
+		_, err = proxy.writeCachedResponse(conn, req, cachedEntry)
 		if err != nil {
 			return err
 		}
-		log.ProxyHTTPResponse(req, resp, duration, true)
-		metrics.AddMetrics(reqURL, cachedEntry, duration, int64(len(resp.String())))
+		duration := time.Since(startTime)
+		bandwidth := int64(len(resp.String()))
+		log.ProxyHTTPResponse(req, resp, bandwidth, duration, true)
+		proxy.metrics.AddMetrics(reqURL, cachedEntry, duration, bandwidth)
+		proxy.cache.Hit(reqURL, cachedEntry)
 		return nil
 	}
 
-	// Forward response to client.
-	fmt.Fprint(conn, resp)
+	proxy.cache.Invalidate(reqURL, req.Method, resp)
+	if req.Method == "GET" || req.Method == "HEAD" {
+		proxy.cache.Miss(reqURL)
+	}
+	// Forward response to client while it is being cached.
+	err = proxy.cache.CacheResponse(reqURL, req.Method, req.Headers, resp, startTime)
+	if err != nil {
+		return err
+	}
+	// Responses which can't be cached end the flight rather than being shared.
+	if flight != nil {
+		flight.Start(resp)
+	}
+	bandwidth, err := conn.writeResponse(req, resp)
+	if err != nil {
+		return err
+	}
+	duration := time.Since(startTime)
+	log.ProxyHTTPResponse(req, resp, bandwidth, duration, false)
+
+	return nil
+}
+
+// serveStale writes a stale cache entry to the client with the warnings
+// specified. The reason the stale entry was served is logged.
+func (proxy *proxy) serveStale(
+	conn *clientConn,
+	req *http.Request,
+	cachedEntry *cache.Entry,
+	startTime time.Time,
+	reason string,
+	warnings ...string,
+) (err error) {
+	reqURL := req.URL()
+	headers := http.Headers{}
+	for _, warning := range warnings {
+		headers.Add("Warning", warning)
+	}
+	cachedResp, err := proxy.writeCachedResponse(conn, req, cachedEntry, headers...)
+	if err != nil {
+		return err
+	}
+	duration := time.Since(startTime)
+	log.ProxyCacheServeStale(reqURL, reason)
+	log.ProxyHTTPResponse(req, cachedResp, 0, duration, true)
+	proxy.metrics.AddMetrics(reqURL, cachedEntry, duration, 0)
+	proxy.cache.Hit(reqURL, cachedEntry)
+
+	return nil
+}
+
+// writeCachedResponse writes the response to the request from the cache entry
+// with the headers specified added. A 304 Not Modified response is written if
+// the validators of the request match the entry, the bytes not sent are
+// counted apart from the bandwidth saved which the caller adds for the hit.
+// Otherwise only the ranges asked for are written.
+func (proxy *proxy) writeCachedResponse(
+	conn *clientConn,
+	req *http.Request,
+	cachedEntry *cache.Entry,
+	headers ...http.Header,
+) (cachedResp *http.Response, err error) {
+	notModified := cachedEntry.NotModified(req.Method, req.Headers)
+	if notModified {
+		cachedResp = cachedEntry.NewNotModifiedResponse()
+	} else {
+		cachedResp = cachedEntry.NewRangeResponse(req.Method, req.Headers)
+	}
+	for _, header := range headers {
+		cachedResp.Headers.Add(header.Name, header.Value)
+	}
+	n, err := conn.writeResponse(req, cachedResp)
+	if err != nil {
+		return cachedResp, err
+	}
+	if notModified {
+		proxy.metrics.AddNotModified(req.URL(), cachedEntry.Size()-n)
+	}
+
+	return cachedResp, nil
+}
+
+// writePayloadTooLarge answers a request whose body is larger than the upload
+// limit with a 413 Payload Too Large response. The connection is closed rather
+// than reading the rest of the body.
+func (proxy *proxy) writePayloadTooLarge(
+	conn *clientConn,
+	req *http.Request,
+) (err error) {
+	conn.keepAlive = false
+	resp := newMessageResponse(
+		413,
+		"Payload Too Large",
+		req.HTTPVer,
+		fmt.Sprintf("Request body larger than %d bytes\n", proxy.maxUploadSize),
+	)
+	_, err = conn.writeResponse(req, resp)
+
+	return err
+}
+
+// serveOffline answers the request from the cache while the proxy is offline.
+// Fresh and stale cached responses are served with a 112 warning and a
+// Cache-Status header. Requests without a cached response are sent a 504
+// Gateway Timeout response rather than being forwarded.
+func (proxy *proxy) serveOffline(
+	conn *clientConn,
+	req *http.Request,
+	cachedEntry *cache.Entry,
+	cacheFound bool,
+	startTime time.Time,
+) (err error) {
+	reqURL := req.URL()
+	cacheName := proxy.via
+	if cacheName == "" {
+		cacheName = "goproxy"
+	}
+	if !cacheFound {
+		resp := newMessageResponse(
+			504,
+			"Gateway Timeout",
+			req.HTTPVer,
+			fmt.Sprintf("The proxy is offline and %q is not cached\n", reqURL),
+		)
+		resp.Headers.Set("Cache-Status", cacheName+"; fwd=miss; detail=offline")
+		_, err = conn.writeResponse(req, resp)
+		log.ProxyHTTPResponse(req, resp, 0, time.Since(startTime), false)
+		proxy.cache.Miss(reqURL)
+		return err
+	}
+
+	ttl := cachedEntry.Expires.Sub(startTime)
+	stale := ttl <= 0
+	headers := http.Headers{}
+	if stale {
+		headers.Add("Warning", `110 - "Response is Stale"`)
+	}
+	headers.Add("Warning", `112 - "Disconnected Operation"`)
+	headers.Add(
+		"Cache-Status",
+		fmt.Sprintf("%s; hit; ttl=%d; detail=offline", cacheName, int64(ttl/time.Second)),
+	)
+	cachedResp, err := proxy.writeCachedResponse(conn, req, cachedEntry, headers...)
+	if err != nil {
+		return err
+	}
 	duration := time.Since(startTime)
-	err = cache.CacheResponse(reqURL, resp, duration)
+	if stale {
+		log.ProxyCacheServeStale(reqURL, "offline")
+	}
+	log.ProxyHTTPResponse(req, cachedResp, 0, duration, true)
+	proxy.metrics.AddMetrics(reqURL, cachedEntry, duration, 0)
+	proxy.cache.Hit(reqURL, cachedEntry)
+
+	return nil
+}
+
+// serveCoalesced writes a response shared with another request for the same
+// URL to the client. The bytes sent are counted as bandwidth saved as they were
+// not fetched from the host server again.
+func (proxy *proxy) serveCoalesced(
+	conn *clientConn,
+	req *http.Request,
+	resp *http.Response,
+	startTime time.Time,
+) (err error) {
+	// The flight no longer keeps the body for this request once it is closed.
+	defer resp.Body.Close()
+	reqURL := req.URL()
+	bandwidthSaved, err := conn.writeResponse(req, resp)
 	if err != nil {
 		return err
 	}
-	log.ProxyHTTPResponse(req, resp, duration, false)
+	duration := time.Since(startTime)
+	log.ProxyCacheCoalesce(reqURL)
+	log.ProxyHTTPResponse(req, resp, 0, duration, false)
+	proxy.metrics.AddCoalesced(reqURL, bandwidthSaved)
 
 	return nil
 }
+
+// revalidate revalidates a stale cache entry in the background after it has
+// been served to the client. The request headers are those sent by the client
+// and the headers are the conditional request headers to send to the host
+// server. Only one revalidation of an entry runs at a time. The entry is always
+// revalidated with a GET request, even for a HEAD request, so that a changed
+// response can replace it.
+func (proxy *proxy) revalidate(
+	reqURL string,
+	reqHeaders http.Headers,
+	headers http.Headers,
+	cachedEntry *cache.Entry,
+) {
+	key := reqURL + "\n" + cachedEntry.VaryKey
+	if _, loaded := proxy.revalidating.LoadOrStore(key, true); loaded {
+		return
+	}
+	defer proxy.revalidating.Delete(key)
+
+	// The whole response is fetched so that it can replace the cached response.
+	headers = headers.Clone()
+	headers.Del("Range")
+	headers.Del("If-Range")
+	startTime := time.Now()
+	reqOptions := &httpclient.Options{Method: "GET", Headers: headers}
+	resp, err := proxy.client.Request(reqURL, reqOptions)
+	if err != nil {
+		log.ProxyError(err)
+		return
+	}
+	defer resp.Body.Close()
+	proxy.forwardResponseHeaders(resp)
+	log.ProxyCacheRevalidate(
+		reqURL,
+		headers.Get("If-None-Match"),
+		headers.Get("If-Modified-Since"),
+		resp.StatusCode,
+	)
+
+	switch {
+	case resp.StatusCode == 304:
+		proxy.cache.Revalidate(cachedEntry, resp, startTime)
+	case cachedEntry.StaleIfError(time.Now(), resp.StatusCode, proxy.staleIfError):
+		// Keep the stale entry rather than caching the error.
+	default:
+		// Read the body so that the new response is cached.
+		err = proxy.cache.CacheResponse(reqURL, "GET", reqHeaders, resp, startTime)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+		}
+		if err != nil {
+			log.ProxyError(err)
+		}
+	}
+}
@@ -1,109 +1,573 @@
 package cache
 
 import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lexesjan/go-web-proxy-server/pkg/http"
 	"github.com/lexesjan/go-web-proxy-server/pkg/log"
 )
 
-// Cache represents the proxy cache
+// Cache represents the proxy cache. The cached responses are kept in a
+// Storage. Each URL maps to the variants of the response stored for it.
 type Cache struct {
-	cacheMap *sync.Map
+	storage      Storage
+	maxEntrySize int64
+	scheduler    *scheduler
+	// offline and maxStale are accessed atomically.
+	offline  int32
+	maxStale int64
+	// mu guards the hit and miss counts, the flights and the rules. The hits of
+	// each variant are kept by URL so they can be forgotten when the URL is
+	// removed. The rules are kept by pattern.
+	mu        sync.Mutex
+	hits      map[string]map[string]int64
+	numHits   int64
+	numMisses int64
+	flights   map[string]*Flight
+	rules     map[string]*Rule
 }
 
-// NewCache returns a new Cache
-func NewCache() (cache *Cache) {
-	cache = &Cache{cacheMap: &sync.Map{}}
+// NewCache returns a new Cache which keeps responses in the storage specified.
+// Response bodies larger than maxEntrySize bytes are not cached.
+func NewCache(storage Storage, maxEntrySize int64) (cache *Cache) {
+	cache = &Cache{
+		storage:      storage,
+		maxEntrySize: maxEntrySize,
+		hits:         make(map[string]map[string]int64),
+		flights:      make(map[string]*Flight),
+		rules:        make(map[string]*Rule),
+	}
+	cache.scheduler = newScheduler(cache.expired)
+	if storage, ok := storage.(evictingStorage); ok {
+		storage.setEvicted(cache.evicted)
+	}
 
 	return cache
 }
 
-// Entry represents a cache entry
+// evicted forgets the hit count and expiry time of a variant of the URL which
+// the storage evicted.
+func (cache *Cache) evicted(reqURL string, id string) {
+	cache.forgetHits(reqURL, id)
+	cache.scheduler.unschedule(reqURL, id)
+}
+
+// forgetHits removes the hit count of a variant of the URL.
+func (cache *Cache) forgetHits(reqURL string, id string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.hits[reqURL], id)
+	if len(cache.hits[reqURL]) == 0 {
+		delete(cache.hits, reqURL)
+	}
+}
+
+// offlineRecheck is how long a variant which would be removed is kept for
+// before it is checked again while the proxy is offline.
+const offlineRecheck = time.Minute
+
+// expired logs a variant of the URL which has become stale. Variants with
+// validators are kept as they can still be revalidated. Variants without
+// validators are kept while they can be served stale and are then removed, as
+// they can only be replaced, so that they don't fill a storage without a size
+// limit. Every variant is kept while the proxy is offline. Variants which are
+// no longer stored were removed without the Cache being told, such as by a
+// key-value server running out of memory, so their hit count is forgotten
+// rather than logged.
+func (cache *Cache) expired(reqURL string, id string) {
+	entries, err := cache.storage.Variants(reqURL)
+	if err != nil {
+		log.ProxyError(err)
+		return
+	}
+
+	for _, entry := range entries {
+		if variantID(reqURL, entry.Vary, entry.VaryKey) != id {
+			continue
+		}
+
+		// The variant was replaced by a fresh response which is scheduled.
+		now := time.Now()
+		if now.Before(entry.Expires) {
+			return
+		}
+		removeAt, ok := entry.removableAt(cache.maxStaleIfError())
+		if !ok {
+			log.ProxyCacheStale(reqURL)
+			return
+		}
+		if now.Before(removeAt) {
+			log.ProxyCacheStale(reqURL)
+			cache.scheduler.schedule(reqURL, entry, removeAt)
+			return
+		}
+		if cache.Offline() {
+			cache.scheduler.schedule(reqURL, entry, now.Add(offlineRecheck))
+			return
+		}
+
+		freed, err := cache.storage.DeleteVariant(reqURL, id)
+		if err != nil {
+			log.ProxyError(err)
+		}
+		log.ProxyCacheRemove(reqURL, freed.Size)
+		break
+	}
+	cache.forgetHits(reqURL, id)
+}
+
+// Entry represents a cache entry. The request time is when the request which
+// fetched the response was sent and the response time is when the response was
+// received. The ETag and LastModified validators are empty if the host server
+// did not send them. Vary holds the names of the request headers which selected
+// the response and VaryKey their normalised values. Lifetime replaces the
+// freshness lifetime of the response if it is not 0. Expires is when the entry
+// becomes stale. Entries must not be changed once they have been stored.
 type Entry struct {
-	Response             string
-	Stale                bool
+	reqURL               string
+	size                 int64
+	element              *list.Element
+	Response             *http.Response
+	Body                 []byte
+	Vary                 []string
+	VaryKey              string
+	Lifetime             time.Duration
+	Expires              time.Time
+	ETag                 string
+	LastModified         string
+	RequestTime          time.Time
+	ResponseTime         time.Time
 	UncachedResponseTime time.Duration
 	UncachedBandwidth    int64
 }
 
-// CacheResponse adds a HTTP response to the cache and starts a timer which
-// marks the cache entry stale
+// Stale reports whether the entry is no longer fresh.
+func (entry *Entry) Stale() bool {
+	return !time.Now().Before(entry.Expires)
+}
+
+// Size returns the size in bytes of the cached response when it was stored.
+func (entry *Entry) Size() (size int64) {
+	return entry.size
+}
+
+// NewResponse returns a new Response which reads the cached response body. The
+// Age header is set to the current age of the entry.
+func (entry *Entry) NewResponse() (resp *http.Response) {
+	resp = &http.Response{
+		StatusCode:        entry.Response.StatusCode,
+		StatusDescription: entry.Response.StatusDescription,
+		Headers:           entry.Response.Headers.Clone(),
+		Body:              ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		HTTPVer:           entry.Response.HTTPVer,
+	}
+
+	age := entry.CurrentAge(time.Now())
+	resp.Headers.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if _, heuristic := entry.FreshnessLifetime(); heuristic &&
+		age > heuristicWarningAge {
+		resp.Headers.Add("Warning", `113 - "Heuristic Expiration"`)
+	}
+
+	return resp
+}
+
+// CacheResponse wraps the body of a HTTP response so that the response is
+// added to the cache once the body has been read in full. The start time is
+// when the request was sent. The response is stored as a variant selected by
+// the request headers named in its Vary header. A timer which marks the cache
+// entry stale is started once the entry is added. The response is not cached
+// if Cacheable reports that it can't be stored or the body is larger than the
+// maximum entry size. The reason it was not cached is logged. The most specific
+// Rule for the URL overrides how the response is cached and is logged.
+// Responses without a body such as 204 No Content are stored straight away as
+// their body is never read.
 func (cache *Cache) CacheResponse(
 	reqURL string,
+	method string,
+	reqHeaders http.Headers,
 	resp *http.Response,
-	duration time.Duration,
+	startTime time.Time,
 ) (err error) {
-	contains := func(arr []string, str string) bool {
-		for _, elem := range arr {
-			if elem == str {
-				return true
-			}
-		}
-		return false
+	rule, found := cache.rule(reqURL)
+	if found {
+		log.ProxyCacheRule(reqURL, rule.String())
+	}
+	if ok, reason := cache.cacheable(reqURL, method, reqHeaders, resp); !ok {
+		log.ProxyCacheSkip(reqURL, reason)
+		return nil
 	}
 
-	newCacheEntry := &Entry{
-		Response:             resp.String(),
-		Stale:                false,
-		UncachedResponseTime: duration,
-		UncachedBandwidth:    int64(len(resp.String())),
+	maxSize := cache.maxEntrySize
+	if rule.MaxSize != 0 && rule.MaxSize < maxSize {
+		maxSize = rule.MaxSize
+	}
+	responseTime := time.Now()
+	// Skip responses which are known to be too large before streaming.
+	contentLength := int64(-1)
+	if resp.Headers.Has("Content-Length") && !resp.Headers.Chunked() {
+		contentLength, err = strconv.ParseInt(
+			resp.Headers.Get("Content-Length"),
+			10,
+			0,
+		)
+		if err != nil || contentLength > maxSize {
+			log.ProxyCacheSkip(reqURL, "the response is too large")
+			return nil
+		}
 	}
 
-	cacheControl := resp.Headers.CacheControl()
-	uncacheable := contains(cacheControl, "no-store") || resp.StatusCode == 304
-	// Can't be cached.
-	if uncacheable {
+	// Copy the headers before they are changed for the client.
+	headers := resp.Headers.Clone()
+	vary := varyHeaders(resp.Headers)
+	varyKey := varyKey(reqHeaders, vary)
+	noBody := !resp.HasBody()
+	store := func(body []byte) {
+		// The whole body is stored so it no longer needs to be chunked.
+		headers.Del("Transfer-Encoding")
+		if !noBody {
+			headers.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		// Caches must add a Date header if the host server did not send one.
+		if _, err := http.ParseTime(headers.Get("Date")); err != nil {
+			headers.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+		}
+
+		newCacheEntry := &Entry{
+			Response: &http.Response{
+				StatusCode:        resp.StatusCode,
+				StatusDescription: resp.StatusDescription,
+				Headers:           headers,
+				HTTPVer:           resp.HTTPVer,
+			},
+			Body:                 body,
+			Vary:                 vary,
+			VaryKey:              varyKey,
+			Lifetime:             rule.TTL,
+			ETag:                 headers.Get("ETag"),
+			LastModified:         headers.Get("Last-Modified"),
+			RequestTime:          startTime,
+			ResponseTime:         responseTime,
+			UncachedResponseTime: time.Since(startTime),
+			UncachedBandwidth:    int64(len(resp.String()) + len(body)),
+		}
+		cache.put(reqURL, newCacheEntry)
+	}
+	if noBody {
+		store([]byte{})
 		return nil
 	}
+	resp.Body = &entryBody{
+		body:          resp.Body,
+		maxSize:       maxSize,
+		contentLength: contentLength,
+		onEOF:         store,
+	}
+
+	return nil
+}
 
-	cache.cacheMap.Store(reqURL, newCacheEntry)
-	err = newCacheEntry.ResetTimer(reqURL, cacheControl)
+// put stores the entry and schedules the time it becomes stale. The size of the
+// entry is set here rather than by the storage so that an entry which is served
+// after it is stored has a size even if the storage did not keep it in memory.
+func (cache *Cache) put(reqURL string, entry *Entry) {
+	entry.reqURL = reqURL
+	entry.Expires = entry.expiresAt()
+	entry.size = int64(len(entry.Response.String()) + len(entry.Body))
+	err := cache.storage.Put(reqURL, entry)
 	if err != nil {
-		return err
+		log.ProxyError(err)
+		return
 	}
 
-	return nil
+	cache.scheduler.schedule(reqURL, entry, entry.Expires)
 }
 
-// ResetTimer resets the timer which marks a cache entry stale
-func (entry *Entry) ResetTimer(
-	reqURL string,
-	cacheControl []string,
-) (err error) {
-	entry.Stale = false
-
-	maxAge := 0
-	for _, elem := range cacheControl {
-		if strings.HasPrefix(elem, "max-age") {
-			tokens := strings.Split(elem, "=")
-			maxAge, err = strconv.Atoi(tokens[1])
-			if err != nil {
-				return err
+// entryBody copies a response body into a buffer while it is being read. The
+// buffer is passed to onEOF once the body has been read in full. Copying stops
+// once the body is larger than maxSize. A body which is not the length given by
+// contentLength is never passed to onEOF so that a response cut short is not
+// stored. A contentLength of -1 means the length is unknown.
+type entryBody struct {
+	body          io.ReadCloser
+	buffer        bytes.Buffer
+	maxSize       int64
+	contentLength int64
+	exceeded      bool
+	onEOF         func(body []byte)
+}
+
+func (entryBody *entryBody) Read(p []byte) (n int, err error) {
+	n, err = entryBody.body.Read(p)
+	if !entryBody.exceeded {
+		if int64(entryBody.buffer.Len()+n) > entryBody.maxSize {
+			// Stop copying and free the buffer.
+			entryBody.exceeded = true
+			entryBody.buffer = bytes.Buffer{}
+		} else {
+			entryBody.buffer.Write(p[:n])
+			if err == io.EOF {
+				entryBody.exceeded = true
+				length := int64(entryBody.buffer.Len())
+				if entryBody.contentLength < 0 || length == entryBody.contentLength {
+					entryBody.onEOF(entryBody.buffer.Bytes())
+				}
 			}
 		}
 	}
 
-	// Mark expired cache as stale
-	time.AfterFunc(time.Duration(maxAge)*time.Second, func() {
-		entry.Stale = true
-		log.ProxyCacheStale(reqURL)
-	})
+	return n, err
+}
 
-	return nil
+func (entryBody *entryBody) Close() (err error) {
+	return entryBody.body.Close()
+}
+
+// ConditionalHeaders returns the headers which make a request conditional on
+// the cached response having changed. The validators stored with the entry are
+// used. No headers are returned if the entry has no validators.
+func (entry *Entry) ConditionalHeaders() (headers http.Headers) {
+	headers = http.Headers{}
+	if entry.ETag != "" {
+		headers.Add("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		headers.Add("If-Modified-Since", entry.LastModified)
+	}
+
+	return headers
+}
+
+// unmergedHeaders are the headers of a 304 Not Modified response which do not
+// replace the stored headers as they describe the framing of the 304 response.
+var unmergedHeaders = []string{"Content-Length", "Transfer-Encoding"}
+
+// Revalidate replaces a cache entry using a 304 Not Modified response from the
+// host server and returns the new entry. The headers of the 304 response
+// replace the stored headers as defined by RFC 7234 section 4.3.4. The start
+// time is when the validation request was sent. The lifetime set by the Rule
+// for the URL is applied again.
+func (cache *Cache) Revalidate(
+	entry *Entry,
+	resp *http.Response,
+	startTime time.Time,
+) (revalidated *Entry) {
+	headers := entry.Response.Headers.Clone()
+	// Warnings about the freshness of the stored response no longer apply.
+	warnings := headers.Values("Warning")
+	headers.Del("Warning")
+	for _, warning := range warnings {
+		if !strings.HasPrefix(warning, "1") {
+			headers.Add("Warning", warning)
+		}
+	}
+
+	replaced := map[string]bool{}
+	for _, header := range resp.Headers {
+		name := strings.ToLower(header.Name)
+		if contains(unmergedHeaders, header.Name) {
+			continue
+		}
+		if replaced[name] {
+			headers.Add(header.Name, header.Value)
+			continue
+		}
+		headers.Set(header.Name, header.Value)
+		replaced[name] = true
+	}
+
+	rule, found := cache.rule(entry.reqURL)
+	if found && rule.TTL != 0 {
+		log.ProxyCacheRule(entry.reqURL, rule.String())
+	}
+
+	// Other requests may be reading the stored entry so a copy is stored.
+	revalidated = &Entry{
+		Response: &http.Response{
+			StatusCode:        entry.Response.StatusCode,
+			StatusDescription: entry.Response.StatusDescription,
+			Headers:           headers,
+			HTTPVer:           entry.Response.HTTPVer,
+		},
+		Body:                 entry.Body,
+		Vary:                 entry.Vary,
+		VaryKey:              entry.VaryKey,
+		Lifetime:             rule.TTL,
+		ETag:                 headers.Get("ETag"),
+		LastModified:         headers.Get("Last-Modified"),
+		RequestTime:          startTime,
+		ResponseTime:         time.Now(),
+		UncachedResponseTime: entry.UncachedResponseTime,
+		UncachedBandwidth:    entry.UncachedBandwidth,
+	}
+	cache.put(entry.reqURL, revalidated)
+
+	return revalidated
+}
+
+// contains reports whether the list contains the string ignoring case.
+func contains(arr []string, str string) bool {
+	for _, elem := range arr {
+		if strings.EqualFold(elem, str) {
+			return true
+		}
+	}
+	return false
 }
 
-// Get returns the cache Entry in the map. The ok result indicates whether the
-// value was found in the map
-func (cache *Cache) Get(key string) (value *Entry, ok bool) {
-	cachedEntryInterface, ok := cache.cacheMap.Load(key)
-	value = &Entry{}
-	if ok {
-		value = cachedEntryInterface.(*Entry)
+// Get returns the cache Entry for the URL which was selected by the same
+// request headers. The ok result indicates whether the value was found in the
+// storage
+func (cache *Cache) Get(
+	reqURL string,
+	reqHeaders http.Headers,
+) (value *Entry, ok bool) {
+	value, ok, err := cache.storage.Get(reqURL, reqHeaders)
+	if err != nil {
+		log.ProxyError(err)
+		return &Entry{}, false
 	}
 
 	return value, ok
 }
+
+// SetOffline sets whether requests must only be answered from the cache as the
+// host servers can't be reached.
+func (cache *Cache) SetOffline(offline bool) {
+	var value int32
+	if offline {
+		value = 1
+	}
+	atomic.StoreInt32(&cache.offline, value)
+}
+
+// SetStaleIfError sets how long the proxy serves stale responses for in place
+// of errors so that responses without validators are kept for that long.
+func (cache *Cache) SetStaleIfError(maxStale time.Duration) {
+	atomic.StoreInt64(&cache.maxStale, int64(maxStale))
+}
+
+// maxStaleIfError returns how long the proxy serves stale responses for in
+// place of errors.
+func (cache *Cache) maxStaleIfError() (maxStale time.Duration) {
+	return time.Duration(atomic.LoadInt64(&cache.maxStale))
+}
+
+// Offline reports whether requests must only be answered from the cache.
+func (cache *Cache) Offline() bool {
+	return atomic.LoadInt32(&cache.offline) == 1
+}
+
+// Hit counts a request for the URL answered with the cached entry.
+func (cache *Cache) Hit(reqURL string, entry *Entry) {
+	id := variantID(reqURL, entry.Vary, entry.VaryKey)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, ok := cache.hits[reqURL]; !ok {
+		cache.hits[reqURL] = make(map[string]int64)
+	}
+	cache.hits[reqURL][id]++
+	cache.numHits++
+}
+
+// Miss counts a request for the URL which had to be forwarded to the host
+// server.
+func (cache *Cache) Miss(reqURL string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.numMisses++
+}
+
+// delete removes every variant of the URL along with their hit counts and
+// expiry times.
+func (cache *Cache) delete(reqURL string) (freed Stats, err error) {
+	cache.mu.Lock()
+	delete(cache.hits, reqURL)
+	cache.mu.Unlock()
+	cache.scheduler.unscheduleURL(reqURL)
+
+	return cache.storage.Delete(reqURL)
+}
+
+// safeMethods are the methods which don't change the resources on the host
+// server as defined by RFC 7231 section 4.2.1.
+var safeMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE"}
+
+// Invalidate removes the cached responses which an unsafe request may have
+// changed as defined by RFC 7234 section 4.4. The responses for the request URL
+// and the URLs in the Location and Content-Location headers of the response are
+// removed if the response is successful. Location URLs are only removed if they
+// have the same host as the request URL so that a host server can't remove the
+// responses of another host. Each URL removed is logged.
+func (cache *Cache) Invalidate(reqURL string, method string, resp *http.Response) {
+	if contains(safeMethods, method) || resp.StatusCode < 200 ||
+		resp.StatusCode >= 400 {
+		return
+	}
+
+	base, err := url.Parse(reqURL)
+	if err != nil {
+		log.ProxyError(err)
+		return
+	}
+	invalidURLs := []string{reqURL}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if !resp.Headers.Has(name) {
+			continue
+		}
+		location, err := base.Parse(resp.Headers.Get(name))
+		if err != nil || !strings.EqualFold(location.Scheme, base.Scheme) ||
+			!strings.EqualFold(location.Host, base.Host) {
+			continue
+		}
+		location.Fragment = ""
+		if location.String() != reqURL {
+			invalidURLs = append(invalidURLs, location.String())
+		}
+	}
+
+	for _, invalidURL := range invalidURLs {
+		_, err = cache.delete(invalidURL)
+		if err != nil {
+			log.ProxyError(err)
+			continue
+		}
+		log.ProxyCacheInvalidate(invalidURL, method)
+	}
+}
+
+func (cache *Cache) String() string {
+	var builder strings.Builder
+
+	stats, err := cache.storage.Stats()
+	if err != nil {
+		return fmt.Sprintf("cache: %s", err)
+	}
+
+	prefix := ""
+	fmt.Fprintf(&builder, "%scache: %d entries, %d bytes\n", prefix, stats.Entries, stats.Size)
+	prefix = "   "
+	err = cache.storage.Range(func(reqURL string, numVariants int) bool {
+		fmt.Fprintf(&builder, "%s - %q: %d variants\n", prefix, reqURL, numVariants)
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(&builder, "%s - %s\n", prefix, err)
+	}
+
+	return strings.TrimRight(builder.String(), "\n")
+}
@@ -0,0 +1,342 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+	"github.com/lexesjan/go-web-proxy-server/pkg/redis"
+)
+
+// newFreshEntry returns an entry received now which is fresh for an hour.
+func newFreshEntry(body string) (entry *Entry) {
+	now := time.Now()
+	entry = newTestEntry(body, []string{}, http.Headers{})
+	entry.Response.Headers.Set("Date", now.UTC().Format(http.TimeFormat))
+	entry.Response.Headers.Set("Cache-Control", "max-age=3600")
+	entry.RequestTime = now
+	entry.ResponseTime = now
+
+	return entry
+}
+
+// TestCacheConcurrent runs requests for the same URLs at once so that the race
+// detector can check the Cache, its storage and the scheduler. The storage is
+// small so that responses are evicted while they are being used.
+func TestCacheConcurrent(t *testing.T) {
+	const numWorkers = 8
+	const numRequests = 500
+	const numURLs = 16
+
+	cache := NewCache(NewMemoryStorage(1024, nil), 512)
+	body := strings.Repeat("x", 100)
+	var wg sync.WaitGroup
+	for worker := 0; worker < numWorkers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < numRequests; i++ {
+				reqURL := fmt.Sprintf("http://www.example.com/%d", (worker+i)%numURLs)
+				entry, ok := cache.Get(reqURL, http.Headers{})
+				switch {
+				case !ok:
+					cache.Miss(reqURL)
+					cache.put(reqURL, newFreshEntry(body))
+				case i%5 == 0:
+					notModified := &http.Response{
+						StatusCode: 304,
+						Headers: http.Headers{
+							{Name: "Date", Value: time.Now().UTC().Format(http.TimeFormat)},
+						},
+					}
+					cache.Hit(reqURL, cache.Revalidate(entry, notModified, time.Now()))
+				case i%7 == 0:
+					if _, err := cache.Purge(reqURL); err != nil {
+						t.Errorf("Purge(%q) error: %s", reqURL, err)
+					}
+				default:
+					cache.Hit(reqURL, entry)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// Variants which were evicted or purged must no longer be scheduled.
+	cache.scheduler.mu.Lock()
+	scheduled := map[string]string{}
+	for id, expiry := range cache.scheduler.ids {
+		scheduled[id] = expiry.reqURL
+	}
+	numScheduled := len(cache.scheduler.heap)
+	cache.scheduler.mu.Unlock()
+
+	if numScheduled != len(scheduled) {
+		t.Errorf("scheduler heap has %d expiries, want %d", numScheduled, len(scheduled))
+	}
+	for id, reqURL := range scheduled {
+		entries, err := cache.storage.Variants(reqURL)
+		if err != nil {
+			t.Fatalf("Variants(%q) error: %s", reqURL, err)
+		}
+		stored := false
+		for _, entry := range entries {
+			stored = stored || variantID(reqURL, entry.Vary, entry.VaryKey) == id
+		}
+		if !stored {
+			t.Errorf("variant of %q is scheduled but not stored", reqURL)
+		}
+	}
+}
+
+// TestCacheResponseNoBody checks that responses without a body are stored even
+// though their body is never read.
+func TestCacheResponseNoBody(t *testing.T) {
+	diskStorage, err := NewDiskStorage(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages := []struct {
+		name    string
+		storage Storage
+	}{
+		{"memory", NewMemoryStorage(0, nil)},
+		{"disk", diskStorage},
+	}
+
+	const reqURL = "http://www.example.com/ping"
+	for _, test := range storages {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewCache(test.storage, 1024)
+			resp := &http.Response{
+				StatusCode:        204,
+				StatusDescription: "No Content",
+				Headers: http.Headers{
+					{Name: "Date", Value: time.Now().UTC().Format(http.TimeFormat)},
+					{Name: "Cache-Control", Value: "max-age=60"},
+				},
+				Body:    ioutil.NopCloser(strings.NewReader("")),
+				HTTPVer: "HTTP/1.1",
+			}
+			err := cache.CacheResponse(reqURL, "GET", http.Headers{}, resp, time.Now())
+			if err != nil {
+				t.Fatalf("CacheResponse() error: %s", err)
+			}
+
+			entry, ok := cache.Get(reqURL, http.Headers{})
+			if !ok {
+				t.Fatalf("Get() did not find the 204 response")
+			}
+			if entry.Response.StatusCode != 204 || len(entry.Body) != 0 ||
+				entry.Response.Headers.Has("Content-Length") {
+				t.Errorf(
+					"Get() = %d with %d bytes and Content-Length %q, want 204 without a body",
+					entry.Response.StatusCode,
+					len(entry.Body),
+					entry.Response.Headers.Get("Content-Length"),
+				)
+			}
+		})
+	}
+}
+
+func TestCacheForgetsEvicted(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	size := int64(len(newFreshEntry(body).Response.String()) + len(body))
+	// The storage only has room for two responses.
+	cache := NewCache(NewMemoryStorage(2*size, nil), size)
+
+	reqURLs := []string{
+		"http://www.example.com/1",
+		"http://www.example.com/2",
+		"http://www.example.com/3",
+	}
+	for _, reqURL := range reqURLs {
+		cache.put(reqURL, newFreshEntry(body))
+		entry, ok := cache.Get(reqURL, http.Headers{})
+		if !ok {
+			t.Fatalf("Get(%q) did not find the response", reqURL)
+		}
+		cache.Hit(reqURL, entry)
+	}
+
+	evictedURL := reqURLs[0]
+	if _, ok := cache.Get(evictedURL, http.Headers{}); ok {
+		t.Fatalf("Get(%q) found the least recently used response", evictedURL)
+	}
+	cache.mu.Lock()
+	_, hitsKept := cache.hits[evictedURL]
+	numURLs := len(cache.hits)
+	cache.mu.Unlock()
+	if hitsKept || numURLs != 2 {
+		t.Errorf("hits kept for %d URLs including %q: %t, want 2 URLs", numURLs, evictedURL, hitsKept)
+	}
+
+	cache.scheduler.mu.Lock()
+	_, scheduled := cache.scheduler.urls[evictedURL]
+	numScheduled := len(cache.scheduler.ids)
+	cache.scheduler.mu.Unlock()
+	if scheduled || numScheduled != 2 {
+		t.Errorf("%d variants scheduled including %q: %t, want 2", numScheduled, evictedURL, scheduled)
+	}
+}
+
+// TestRevalidateSize checks that a revalidated entry has a size even if the
+// storage does not keep it in memory.
+func TestRevalidateSize(t *testing.T) {
+	storages := []struct {
+		name    string
+		storage Storage
+	}{
+		{"redis", NewRedisStorage(redis.NewClient(newFakeRedis(t).addr(), time.Second))},
+		// The storage is too small to store the entry.
+		{"memory", NewMemoryStorage(1, nil)},
+	}
+
+	const reqURL = "http://www.example.com/revalidated"
+	for _, test := range storages {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewCache(test.storage, 1024)
+			entry := newFreshEntry("revalidated")
+			entry.reqURL = reqURL
+			notModified := &http.Response{
+				StatusCode: 304,
+				Headers: http.Headers{
+					{Name: "Date", Value: time.Now().UTC().Format(http.TimeFormat)},
+				},
+			}
+
+			revalidated := cache.Revalidate(entry, notModified, time.Now())
+			want := int64(len(revalidated.Response.String()) + len(revalidated.Body))
+			if revalidated.Size() != want {
+				t.Errorf("Size() = %d, want %d", revalidated.Size(), want)
+			}
+		})
+	}
+}
+
+// TestCacheResponseTruncated checks that a response whose body ends before its
+// Content-Length is not stored.
+func TestCacheResponseTruncated(t *testing.T) {
+	const reqURL = "http://www.example.com/truncated"
+	cache := NewCache(NewMemoryStorage(0, nil), 1024)
+	resp := &http.Response{
+		StatusCode:        200,
+		StatusDescription: "OK",
+		Headers: http.Headers{
+			{Name: "Date", Value: time.Now().UTC().Format(http.TimeFormat)},
+			{Name: "Cache-Control", Value: "max-age=60"},
+			{Name: "Content-Length", Value: "100"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader("short")),
+		HTTPVer: "HTTP/1.1",
+	}
+	err := cache.CacheResponse(reqURL, "GET", http.Headers{}, resp, time.Now())
+	if err != nil {
+		t.Fatalf("CacheResponse() error: %s", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	if entry, ok := cache.Get(reqURL, http.Headers{}); ok {
+		t.Errorf("Get() found a %d byte body, want none stored", len(entry.Body))
+	}
+}
+
+// TestCacheRemovesExpired checks that a stale response is removed once it can
+// no longer be served stale only if it can't be revalidated.
+func TestCacheRemovesExpired(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		value        string
+		staleIfError time.Duration
+		offline      bool
+		kept         bool
+	}{
+		{name: "no validators"},
+		{name: "must-revalidate", header: "Cache-Control", value: "max-age=60, must-revalidate"},
+		{name: "ETag", header: "ETag", value: `"v1"`, kept: true},
+		{
+			name:   "Last-Modified",
+			header: "Last-Modified",
+			value:  "Mon, 02 Jan 2006 15:04:05 GMT",
+			kept:   true,
+		},
+		{
+			name:   "within stale-while-revalidate",
+			header: "Cache-Control",
+			value:  "max-age=60, stale-while-revalidate=315360000",
+			kept:   true,
+		},
+		{
+			name:   "past stale-if-error",
+			header: "Cache-Control",
+			value:  "max-age=60, stale-if-error=1",
+		},
+		{name: "within the proxy stale-if-error", staleIfError: 24 * 365 * 10 * time.Hour, kept: true},
+		{name: "offline", offline: true, kept: true},
+	}
+
+	const reqURL = "http://www.example.com/expired"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk, err := NewDiskStorage(t.TempDir(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storages := []struct {
+				name    string
+				storage Storage
+			}{
+				{"memory", NewMemoryStorage(0, nil)},
+				{"tiered", NewTieredStorage(NewMemoryStorage(0, nil), disk)},
+				{"redis", NewRedisStorage(redis.NewClient(newFakeRedis(t).addr(), time.Second))},
+			}
+			for _, storage := range storages {
+				t.Run(storage.name, func(t *testing.T) {
+					cache := NewCache(storage.storage, 1024)
+					cache.SetStaleIfError(test.staleIfError)
+					cache.SetOffline(test.offline)
+					// The entry has been stale since long before the test.
+					entry := newTestEntry("expired", []string{}, http.Headers{})
+					if test.header != "" {
+						entry.Response.Headers.Set(test.header, test.value)
+						entry.ETag = entry.Response.Headers.Get("ETag")
+						entry.LastModified = entry.Response.Headers.Get("Last-Modified")
+					}
+					cache.put(reqURL, entry)
+					cache.Hit(reqURL, entry)
+
+					cache.expired(reqURL, variantID(reqURL, entry.Vary, entry.VaryKey))
+					entries, err := storage.storage.Variants(reqURL)
+					if err != nil {
+						t.Fatalf("Variants() error: %s", err)
+					}
+					if kept := len(entries) == 1; kept != test.kept {
+						t.Fatalf("%d variants stored, want kept %t", len(entries), test.kept)
+					}
+					if test.kept {
+						return
+					}
+					stats, err := storage.storage.Stats()
+					if err != nil || stats.Entries != 0 {
+						t.Errorf("Stats() = %+v, %v, want no entries", stats, err)
+					}
+					cache.mu.Lock()
+					numURLs := len(cache.hits)
+					cache.mu.Unlock()
+					if numURLs != 0 {
+						t.Errorf("hits kept for %d URLs, want 0", numURLs)
+					}
+				})
+			}
+		})
+	}
+}
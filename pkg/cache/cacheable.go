@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// Cacheable reports whether a shared cache may store the response to a request
+// with the method and headers specified as defined by RFC 7234 section 3. The
+// reason result explains why the response can't be stored.
+//
+// Only responses to GET requests are stored. Responses to HEAD requests have
+// no body so they are not stored but HEAD requests are answered with stored
+// GET responses. Responses which set cookies are not stored as the cookies
+// belong to a single client.
+func Cacheable(
+	method string,
+	reqHeaders http.Headers,
+	resp *http.Response,
+) (ok bool, reason string) {
+	_, public := resp.Headers.CacheControlDirective("public")
+	_, sMaxAge := resp.Headers.CacheControlDirective("s-maxage")
+	_, maxAge := resp.Headers.CacheControlDirective("max-age")
+	_, mustRevalidate := resp.Headers.CacheControlDirective("must-revalidate")
+	// The no-store and private directives may list header names.
+	_, noStore := resp.Headers.CacheControlDirective("no-store")
+	_, private := resp.Headers.CacheControlDirective("private")
+
+	switch {
+	case method != "GET":
+		return false, "the request method is " + method
+	case NoStore(reqHeaders):
+		return false, "the request has a no-store directive"
+	case noStore:
+		return false, "the response has a no-store directive"
+	case private:
+		return false, "the response is private"
+	// Responses to requests with credentials may only be shared if the host
+	// server allows it as defined by RFC 7234 section 3.2.
+	case reqHeaders.Has("Authorization") && !public && !sMaxAge && !mustRevalidate:
+		return false, "the request is authorized"
+	case resp.Headers.Has("Set-Cookie"):
+		return false, "the response sets cookies"
+	// A Vary header of * means the response varies on more than the request.
+	case contains(varyHeaders(resp.Headers), "*"):
+		return false, "the response varies on more than the request"
+	case resp.StatusCode == 304:
+		return false, "the response is not modified"
+	// Partial responses can't be served to requests for the whole response.
+	case resp.StatusCode == 206:
+		return false, "the response is partial"
+	// Other status codes may only be cached if the host server says so.
+	case !heuristicallyCacheable[resp.StatusCode] && !public && !sMaxAge &&
+		!maxAge && !resp.Headers.Has("Expires"):
+		return false, "the status code is not cacheable by default"
+	}
+
+	return true, ""
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+func TestCacheable(t *testing.T) {
+	authorized := http.Headers{{Name: "Authorization", Value: "Basic dXNlcjpwYXNz"}}
+	tests := []struct {
+		name        string
+		method      string
+		reqHeaders  http.Headers
+		statusCode  int
+		respHeaders http.Headers
+		reason      string
+		ok          bool
+	}{
+		{
+			name:        "cacheable",
+			method:      "GET",
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "max-age=60"}},
+			ok:          true,
+		},
+		{
+			name:       "no freshness information",
+			method:     "GET",
+			statusCode: 200,
+			ok:         true,
+		},
+		{
+			name:       "request method",
+			method:     "POST",
+			statusCode: 200,
+			reason:     "the request method is POST",
+		},
+		{
+			name:       "HEAD request",
+			method:     "HEAD",
+			statusCode: 200,
+			reason:     "the request method is HEAD",
+		},
+		{
+			name:       "request no-store",
+			method:     "GET",
+			reqHeaders: http.Headers{{Name: "Cache-Control", Value: "no-store"}},
+			statusCode: 200,
+			reason:     "the request has a no-store directive",
+		},
+		{
+			name:        "response no-store",
+			method:      "GET",
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "max-age=60, no-store"}},
+			reason:      "the response has a no-store directive",
+		},
+		{
+			name:        "private",
+			method:      "GET",
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "private"}},
+			reason:      "the response is private",
+		},
+		{
+			name:       "qualified private",
+			method:     "GET",
+			statusCode: 200,
+			respHeaders: http.Headers{
+				{Name: "Cache-Control", Value: `private="Set-Cookie", max-age=60`},
+			},
+			reason: "the response is private",
+		},
+		{
+			name:       "authorized",
+			method:     "GET",
+			reqHeaders: authorized,
+			statusCode: 200,
+			respHeaders: http.Headers{
+				{Name: "Cache-Control", Value: "max-age=60"},
+			},
+			reason: "the request is authorized",
+		},
+		{
+			name:        "authorized and public",
+			method:      "GET",
+			reqHeaders:  authorized,
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "public"}},
+			ok:          true,
+		},
+		{
+			name:        "authorized and s-maxage",
+			method:      "GET",
+			reqHeaders:  authorized,
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "s-maxage=60"}},
+			ok:          true,
+		},
+		{
+			name:       "authorized and must-revalidate",
+			method:     "GET",
+			reqHeaders: authorized,
+			statusCode: 200,
+			respHeaders: http.Headers{
+				{Name: "Cache-Control", Value: "max-age=60, must-revalidate"},
+			},
+			ok: true,
+		},
+		{
+			name:        "sets cookies",
+			method:      "GET",
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Set-Cookie", Value: "id=1"}},
+			reason:      "the response sets cookies",
+		},
+		{
+			name:        "varies on more than the request",
+			method:      "GET",
+			statusCode:  200,
+			respHeaders: http.Headers{{Name: "Vary", Value: "*"}},
+			reason:      "the response varies on more than the request",
+		},
+		{
+			name:       "not modified",
+			method:     "GET",
+			statusCode: 304,
+			reason:     "the response is not modified",
+		},
+		{
+			name:       "partial",
+			method:     "GET",
+			statusCode: 206,
+			reason:     "the response is partial",
+		},
+		{
+			name:       "status code not cacheable by default",
+			method:     "GET",
+			statusCode: 302,
+			reason:     "the status code is not cacheable by default",
+		},
+		{
+			name:        "status code not cacheable by default with max-age",
+			method:      "GET",
+			statusCode:  302,
+			respHeaders: http.Headers{{Name: "Cache-Control", Value: "max-age=60"}},
+			ok:          true,
+		},
+		{
+			name:        "status code not cacheable by default with Expires",
+			method:      "GET",
+			statusCode:  500,
+			respHeaders: http.Headers{{Name: "Expires", Value: testDate(0)}},
+			ok:          true,
+		},
+		{
+			name:       "no content",
+			method:     "GET",
+			statusCode: 204,
+			ok:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.statusCode, Headers: test.respHeaders}
+			ok, reason := Cacheable(test.method, test.reqHeaders, resp)
+			if ok != test.ok || reason != test.reason {
+				t.Errorf(
+					"Cacheable() = %t, %q, want %t, %q",
+					ok,
+					reason,
+					test.ok,
+					test.reason,
+				)
+			}
+		})
+	}
+}
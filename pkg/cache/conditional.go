@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// notModifiedHeaders are the headers of a cached response which are sent in a
+// 304 Not Modified response as defined by RFC 7232 section 4.1.
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Vary",
+	"Age",
+	"Warning",
+	"Via",
+}
+
+// NotModified reports whether a request with the method and headers specified
+// already holds the cached response as its validators match the entry as
+// defined by RFC 7232 section 6. The If-None-Match header is compared with the
+// ETag of the entry using the weak comparison and takes precedence over the
+// If-Modified-Since header. The If-Modified-Since header is compared with the
+// Last-Modified date of the entry or its Date if it has none.
+func (entry *Entry) NotModified(method string, reqHeaders http.Headers) bool {
+	if (method != "GET" && method != "HEAD") || entry.Response.StatusCode != 200 {
+		return false
+	}
+
+	if reqHeaders.Has("If-None-Match") {
+		for _, etag := range reqHeaders.List("If-None-Match") {
+			if etag == "*" || weakMatch(etag, entry.ETag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(reqHeaders.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(entry.LastModified)
+	if err != nil {
+		lastModified = dateValue(entry.Response.Headers, entry.ResponseTime)
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+// weakMatch reports whether two entity tags match ignoring whether they are
+// weak.
+func weakMatch(etag string, other string) bool {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	other = strings.TrimPrefix(strings.TrimSpace(other), "W/")
+
+	return etag != "" && etag == other
+}
+
+// NewNotModifiedResponse returns a new 304 Not Modified response for the cached
+// response. Only the headers which a 304 response may update are sent.
+func (entry *Entry) NewNotModifiedResponse() (resp *http.Response) {
+	cachedResp := entry.NewResponse()
+	headers := http.Headers{}
+	for _, header := range cachedResp.Headers {
+		if contains(notModifiedHeaders, header.Name) {
+			headers = append(headers, header)
+		}
+	}
+
+	return &http.Response{
+		StatusCode:        304,
+		StatusDescription: "Not Modified",
+		Headers:           headers,
+		Body:              http.NoBody,
+		HTTPVer:           cachedResp.HTTPVer,
+	}
+}
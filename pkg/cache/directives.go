@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// NoCache reports whether the client requires cached responses to be
+// validated with the host server before they are used. The Pragma header is
+// only used if the request has no Cache-Control header as defined by RFC 7234
+// section 5.4.
+func NoCache(reqHeaders http.Headers) bool {
+	if _, ok := reqHeaders.CacheControlDirective("no-cache"); ok {
+		return true
+	}
+
+	return !reqHeaders.Has("Cache-Control") &&
+		contains(reqHeaders.List("Pragma"), "no-cache")
+}
+
+// NoStore reports whether the client forbids the response to the request from
+// being cached.
+func NoStore(reqHeaders http.Headers) bool {
+	_, ok := reqHeaders.CacheControlDirective("no-store")
+	return ok
+}
+
+// OnlyIfCached reports whether the client only wants a cached response.
+func OnlyIfCached(reqHeaders http.Headers) bool {
+	_, ok := reqHeaders.CacheControlDirective("only-if-cached")
+	return ok
+}
+
+// requestDelta returns the delta-seconds value of a request directive. The ok
+// result indicates whether the directive is present with a valid value.
+func requestDelta(
+	reqHeaders http.Headers,
+	directive string,
+) (delta time.Duration, ok bool) {
+	value, ok := reqHeaders.CacheControlDirective(directive)
+	if !ok {
+		return 0, false
+	}
+
+	return parseDeltaSeconds(value)
+}
+
+// Satisfies reports whether the cached response can be served without
+// validation to a request with the headers specified as defined by RFC 7234
+// section 5.2.1. The max-age, min-fresh and no-cache directives of the request
+// make the response unusable sooner and the max-stale directive allows a stale
+// response to be served. A response with a no-cache directive is never served
+// without validation as defined by RFC 7234 section 5.2.2.2. The stale result
+// indicates whether the response is stale.
+func (entry *Entry) Satisfies(
+	reqHeaders http.Headers,
+	now time.Time,
+) (ok bool, stale bool) {
+	remaining := entry.Expires.Sub(now)
+	if _, noCache := entry.Response.Headers.CacheControlDirective("no-cache"); noCache {
+		return false, remaining <= 0
+	}
+	if NoCache(reqHeaders) {
+		return false, false
+	}
+
+	if maxAge, ok := requestDelta(reqHeaders, "max-age"); ok &&
+		entry.CurrentAge(now) > maxAge {
+		return false, false
+	}
+	if minFresh, ok := requestDelta(reqHeaders, "min-fresh"); ok &&
+		remaining < minFresh {
+		return false, false
+	}
+	if remaining > 0 {
+		return true, false
+	}
+
+	value, ok := reqHeaders.CacheControlDirective("max-stale")
+	if !ok || entry.mustRevalidate() {
+		return false, true
+	}
+	// A max-stale directive without a value accepts any stale response.
+	maxStale, valid := parseDeltaSeconds(value)
+	if strings.TrimSpace(value) == "" || (valid && -remaining <= maxStale) {
+		return true, true
+	}
+
+	return false, true
+}
+
+// constrainsFreshness reports whether the request sets its own limits on the
+// freshness of cached responses.
+func constrainsFreshness(reqHeaders http.Headers) bool {
+	if NoCache(reqHeaders) {
+		return true
+	}
+	for _, directive := range []string{"max-age", "min-fresh"} {
+		if _, ok := reqHeaders.CacheControlDirective(directive); ok {
+			return true
+		}
+	}
+
+	return false
+}
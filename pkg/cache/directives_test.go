@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		reqHeaders   http.Headers
+		age          time.Duration
+		ok           bool
+		stale        bool
+	}{
+		{
+			name:         "fresh",
+			cacheControl: "max-age=3600",
+			age:          time.Minute,
+			ok:           true,
+		},
+		{
+			name:         "stale",
+			cacheControl: "max-age=60",
+			age:          2 * time.Minute,
+			stale:        true,
+		},
+		{
+			name:         "fresh with no-cache",
+			cacheControl: "no-cache, max-age=3600",
+			age:          time.Minute,
+		},
+		{
+			name:         "fresh with qualified no-cache",
+			cacheControl: `no-cache="Set-Cookie", max-age=3600`,
+			age:          time.Minute,
+		},
+		{
+			name:         "stale with no-cache and max-stale",
+			cacheControl: "no-cache, max-age=60",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "max-stale"}},
+			age:          2 * time.Minute,
+			stale:        true,
+		},
+		{
+			name:         "request no-cache",
+			cacheControl: "max-age=3600",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "no-cache"}},
+			age:          time.Minute,
+		},
+		{
+			name:         "request Pragma no-cache",
+			cacheControl: "max-age=3600",
+			reqHeaders:   http.Headers{{Name: "Pragma", Value: "no-cache"}},
+			age:          time.Minute,
+		},
+		{
+			name:         "older than request max-age",
+			cacheControl: "max-age=3600",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "max-age=30"}},
+			age:          time.Minute,
+		},
+		{
+			name:         "not fresh for request min-fresh",
+			cacheControl: "max-age=120",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "min-fresh=90"}},
+			age:          time.Minute,
+		},
+		{
+			name:         "stale within max-stale",
+			cacheControl: "max-age=60",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "max-stale=120"}},
+			age:          2 * time.Minute,
+			ok:           true,
+			stale:        true,
+		},
+		{
+			name:         "stale beyond max-stale",
+			cacheControl: "max-age=60",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "max-stale=30"}},
+			age:          2 * time.Minute,
+			stale:        true,
+		},
+		{
+			name:         "stale with must-revalidate and max-stale",
+			cacheControl: "max-age=60, must-revalidate",
+			reqHeaders:   http.Headers{{Name: "Cache-Control", Value: "max-stale"}},
+			age:          2 * time.Minute,
+			stale:        true,
+		},
+		{
+			name:         "fresh with must-revalidate",
+			cacheControl: "max-age=3600, must-revalidate",
+			age:          time.Minute,
+			ok:           true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := &Entry{
+				Response: &http.Response{
+					StatusCode: 200,
+					Headers: http.Headers{
+						{Name: "Date", Value: testDate(0)},
+						{Name: "Cache-Control", Value: test.cacheControl},
+					},
+				},
+				RequestTime:  testTime,
+				ResponseTime: testTime,
+			}
+			entry.Expires = entry.expiresAt()
+
+			ok, stale := entry.Satisfies(test.reqHeaders, testTime.Add(test.age))
+			if ok != test.ok || stale != test.stale {
+				t.Errorf(
+					"Satisfies() = %t, %t, want %t, %t",
+					ok,
+					stale,
+					test.ok,
+					test.stale,
+				)
+			}
+		})
+	}
+}
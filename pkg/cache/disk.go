@@ -0,0 +1,395 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// diskExtension is the extension of the files holding cached responses.
+// Responses are written to temporary files first so that a file with this
+// extension is always complete unless the disk itself failed.
+const diskExtension = ".cache"
+
+// diskEntry is a cached response stored in the cache directory. Only the
+// information needed to find the response is kept in memory.
+type diskEntry struct {
+	reqURL  string
+	vary    []string
+	varyKey string
+	path    string
+	size    int64
+	element *list.Element
+}
+
+// DiskStorage is a Storage which keeps responses in a directory so that they
+// are kept when the proxy restarts. Each response is stored in its own file
+// which holds the metadata as a line of JSON followed by the response as it is
+// served. The least recently used files are removed once the size limit is
+// reached.
+type DiskStorage struct {
+	dir     string
+	maxSize int64
+	evicted func(reqURL string, id string)
+	mu      sync.Mutex
+	index   map[string][]*diskEntry
+	lru     *list.List
+	size    int64
+}
+
+// NewDiskStorage returns a DiskStorage which stores responses in the directory
+// specified. The responses already in the directory are indexed from their
+// metadata without reading the responses themselves. Temporary files and files
+// shorter or longer than their metadata says are removed. A limit of 0 allows
+// any size.
+func NewDiskStorage(dir string, maxSize int64) (storage *DiskStorage, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return &DiskStorage{}, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return &DiskStorage{}, err
+	}
+	// Index the most recently used files last so that they are at the front.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	storage = &DiskStorage{
+		dir:     dir,
+		maxSize: maxSize,
+		index:   make(map[string][]*diskEntry),
+		lru:     list.New(),
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.IsDir() || filepath.Ext(path) != diskExtension {
+			// Left behind by a write which did not finish.
+			if strings.HasSuffix(path, ".tmp") {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		metadata, err := readDiskMetadata(path, file.Size())
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		storage.addLocked(&diskEntry{
+			reqURL:  metadata.URL,
+			vary:    metadata.Vary,
+			varyKey: metadata.VaryKey,
+			path:    path,
+			size:    file.Size(),
+		})
+	}
+	storage.evictLocked()
+
+	return storage, nil
+}
+
+// variantID returns a name for the variant of the URL selected by the request
+// headers.
+func variantID(reqURL string, vary []string, varyKey string) (id string) {
+	sum := sha256.Sum256([]byte(
+		reqURL + "\n" + strings.Join(vary, ",") + "\n" + varyKey,
+	))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// readDiskMetadata reads the metadata of a cached response from a file of the
+// size specified. An error is returned if the file is not the size recorded in
+// the metadata. Files written before the size was recorded are only checked
+// when they are read.
+func readDiskMetadata(path string, size int64) (metadata *entryMetadata, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return &entryMetadata{}, err
+	}
+	defer file.Close()
+
+	metadata, length, err := decodeMetadata(bufio.NewReader(file))
+	if err != nil {
+		return &entryMetadata{}, err
+	}
+	if metadata.Size != 0 && length+metadata.Size != size {
+		return &entryMetadata{}, fmt.Errorf(
+			"cached response for %q is not the size recorded",
+			metadata.URL,
+		)
+	}
+
+	return metadata, nil
+}
+
+// readDiskFile reads a cached response from a file. An error is returned if
+// the file is not complete.
+func readDiskFile(path string) (entry *Entry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return &Entry{}, err
+	}
+	defer file.Close()
+
+	return decodeEntry(bufio.NewReader(file))
+}
+
+// Put writes the entry to the cache directory replacing the file of the same
+// variant. Responses larger than the size limit are not written.
+func (storage *DiskStorage) Put(reqURL string, entry *Entry) (err error) {
+	data, err := encodeEntry(reqURL, entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if storage.maxSize > 0 && size > storage.maxSize {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(storage.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	path := filepath.Join(
+		storage.dir,
+		variantID(reqURL, entry.Vary, entry.VaryKey)+diskExtension,
+	)
+	storage.mu.Lock()
+	// Renaming replaces the previous file in one step.
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		storage.mu.Unlock()
+		os.Remove(file.Name())
+		return err
+	}
+	storage.removeLocked(reqURL, path)
+	storage.addLocked(&diskEntry{
+		reqURL:  reqURL,
+		vary:    entry.Vary,
+		varyKey: entry.VaryKey,
+		path:    path,
+		size:    size,
+	})
+	evicted := storage.evictLocked()
+	storage.mu.Unlock()
+
+	if storage.evicted != nil {
+		for _, entry := range evicted {
+			storage.evicted(entry.reqURL, variantID(entry.reqURL, entry.vary, entry.varyKey))
+		}
+	}
+
+	return nil
+}
+
+// setEvicted sets the function called with the URL and variant ID of each
+// response evicted.
+func (storage *DiskStorage) setEvicted(evicted func(reqURL string, id string)) {
+	storage.evicted = evicted
+}
+
+// Get reads the variant of the URL selected by the request headers from the
+// cache directory. Files which can't be read are removed.
+func (storage *DiskStorage) Get(
+	reqURL string,
+	reqHeaders http.Headers,
+) (entry *Entry, ok bool, err error) {
+	storage.mu.Lock()
+	var path string
+	entries := storage.index[reqURL]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if varyKey(reqHeaders, entries[i].vary) == entries[i].varyKey {
+			path = entries[i].path
+			storage.lru.MoveToFront(entries[i].element)
+			break
+		}
+	}
+	storage.mu.Unlock()
+	if path == "" {
+		return &Entry{}, false, nil
+	}
+
+	entry, err = readDiskFile(path)
+	if err != nil {
+		storage.mu.Lock()
+		storage.removeLocked(reqURL, path)
+		storage.mu.Unlock()
+		os.Remove(path)
+		return &Entry{}, false, err
+	}
+	// The modification time orders the files when they are indexed.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return entry, true, nil
+}
+
+// Variants reads every variant of the URL from the cache directory. Files which
+// can't be read are skipped.
+func (storage *DiskStorage) Variants(reqURL string) (entries []*Entry, err error) {
+	storage.mu.Lock()
+	paths := []string{}
+	for _, entry := range storage.index[reqURL] {
+		paths = append(paths, entry.path)
+	}
+	storage.mu.Unlock()
+
+	entries = []*Entry{}
+	for _, path := range paths {
+		entry, err := readDiskFile(path)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Delete removes the files of every variant of the URL.
+func (storage *DiskStorage) Delete(reqURL string) (freed Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, entry := range storage.index[reqURL] {
+		storage.lru.Remove(entry.element)
+		storage.size -= entry.size
+		freed.Entries++
+		freed.Size += entry.size
+		removeErr := os.Remove(entry.path)
+		if err == nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	delete(storage.index, reqURL)
+
+	return freed, err
+}
+
+// DeleteVariant removes the file holding the variant of the URL with the
+// variant ID.
+func (storage *DiskStorage) DeleteVariant(
+	reqURL string,
+	id string,
+) (freed Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, entry := range storage.index[reqURL] {
+		if variantID(reqURL, entry.vary, entry.varyKey) != id {
+			continue
+		}
+
+		storage.removeLocked(reqURL, entry.path)
+		err = os.Remove(entry.path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return Stats{Entries: 1, Size: entry.size}, err
+	}
+
+	return Stats{}, nil
+}
+
+// Range calls f with each URL and the number of variants stored for it. The
+// URLs are copied first so f may use the storage.
+func (storage *DiskStorage) Range(
+	f func(reqURL string, numVariants int) bool,
+) (err error) {
+	storage.mu.Lock()
+	numVariants := make(map[string]int, len(storage.index))
+	for reqURL, entries := range storage.index {
+		numVariants[reqURL] = len(entries)
+	}
+	storage.mu.Unlock()
+
+	for reqURL, n := range numVariants {
+		if !f(reqURL, n) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the number of files in the cache directory and their total
+// size.
+func (storage *DiskStorage) Stats() (stats Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return Stats{Entries: storage.lru.Len(), Size: storage.size}, nil
+}
+
+// addLocked adds the file to the index as the most recently used file. The
+// storage lock must be held.
+func (storage *DiskStorage) addLocked(entry *diskEntry) {
+	storage.index[entry.reqURL] = append(storage.index[entry.reqURL], entry)
+	entry.element = storage.lru.PushFront(entry)
+	storage.size += entry.size
+}
+
+// removeLocked removes the file holding a response for the URL from the index
+// if it is indexed. The file itself is not removed. The storage lock must be
+// held.
+func (storage *DiskStorage) removeLocked(reqURL string, path string) {
+	entries := storage.index[reqURL]
+	for i, entry := range entries {
+		if entry.path != path {
+			continue
+		}
+
+		storage.lru.Remove(entry.element)
+		storage.size -= entry.size
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(storage.index, reqURL)
+		} else {
+			storage.index[reqURL] = entries
+		}
+		return
+	}
+}
+
+// evictLocked removes the least recently used files until the cache directory
+// is within its size limit and returns the files removed. The storage lock
+// must be held.
+func (storage *DiskStorage) evictLocked() (evicted []*diskEntry) {
+	evicted = []*diskEntry{}
+	for storage.maxSize > 0 && storage.size > storage.maxSize {
+		oldest := storage.lru.Back().Value.(*diskEntry)
+		storage.removeLocked(oldest.reqURL, oldest.path)
+		os.Remove(oldest.path)
+		evicted = append(evicted, oldest)
+	}
+
+	return evicted
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// TestDiskStorageIndex checks that the files left in the cache directory are
+// indexed when the storage is created again and that files which are not the
+// size recorded in their metadata are removed.
+func TestDiskStorageIndex(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqURLs := []string{
+		"http://www.example.com/complete",
+		"http://www.example.com/truncated",
+		"http://www.example.com/extended",
+	}
+	for _, reqURL := range reqURLs {
+		err := storage.Put(reqURL, newTestEntry("body of "+reqURL, []string{}, http.Headers{}))
+		if err != nil {
+			t.Fatalf("Put(%q) error: %s", reqURL, err)
+		}
+	}
+	path := func(reqURL string) string {
+		return filepath.Join(dir, variantID(reqURL, []string{}, "")+diskExtension)
+	}
+	info, err := os.Stat(path(reqURLs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path(reqURLs[1]), info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path(reqURLs[2]), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("more")
+	file.Close()
+	// A file written before the size was recorded in the metadata.
+	const oldURL = "http://www.example.com/old"
+	oldEntry := newTestEntry("old", []string{}, http.Headers{})
+	metadata, err := json.Marshal(&entryMetadata{URL: oldURL, Vary: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldData := string(metadata) + "\n" + oldEntry.Response.String() + string(oldEntry.Body)
+	if err := ioutil.WriteFile(path(oldURL), []byte(oldData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = NewDiskStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		reqURL string
+		body   string
+		kept   bool
+	}{
+		{reqURLs[0], "body of " + reqURLs[0], true},
+		{reqURLs[1], "", false},
+		{reqURLs[2], "", false},
+		{oldURL, "old", true},
+	}
+	for _, test := range tests {
+		_, err := os.Stat(path(test.reqURL))
+		if exists := err == nil; exists != test.kept {
+			t.Errorf("file of %q exists: %t, want %t", test.reqURL, exists, test.kept)
+		}
+		entry, ok, err := storage.Get(test.reqURL, http.Headers{})
+		if ok != test.kept || err != nil || string(entry.Body) != test.body {
+			t.Errorf(
+				"Get(%q) = %q, %t, %v, want %q, %t",
+				test.reqURL,
+				entry.Body,
+				ok,
+				err,
+				test.body,
+				test.kept,
+			)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// errFlightAbandoned is returned to requests sharing a flight whose leader
+// stopped before the body was read.
+var errFlightAbandoned = errors.New("shared response was abandoned")
+
+// errFlightTooLarge ends a flight which no other request is reading once its
+// body is larger than the maximum entry size so that it is not kept in memory.
+var errFlightTooLarge = errors.New("shared response is too large")
+
+// errFlightBehind is returned to a request sharing a flight which fell a whole
+// window behind the request which started it.
+var errFlightBehind = errors.New("fell too far behind the shared response")
+
+// errFlightUncacheable ends a flight whose response can't be shared as it could
+// not be cached.
+var errFlightUncacheable = errors.New("response can't be shared")
+
+// Flight is a response being fetched from the host server for a cache miss
+// which concurrent requests for the same URL share. The request which started
+// the flight fetches the response and the other requests are sent it as it
+// streams. The body is kept in a window of at most the maximum entry size which
+// starts at the first byte not yet sent to every request. Once the window is
+// full the requests which have not been sent any of it are detached and their
+// bodies fail, so the request which started the flight never waits for a slow
+// client. Requests which join after the start of the body has left the window
+// fetch the response themselves.
+type Flight struct {
+	cache      *Cache
+	reqURL     string
+	method     string
+	reqHeaders http.Headers
+	// ready is closed once the response has arrived or the flight has failed.
+	ready   chan struct{}
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	resp    *http.Response
+	source  io.Reader
+	// body holds the bytes of the body from offset base onwards.
+	body    []byte
+	base    int64
+	done    bool
+	err     error
+	readers map[*flightReader]bool
+}
+
+// Join returns the flight fetching the URL. The leader result reports whether
+// a new flight was started in which case the caller must fetch the response
+// and call Start or Fail followed by Land.
+func (cache *Cache) Join(
+	reqURL string,
+	method string,
+	reqHeaders http.Headers,
+) (flight *Flight, leader bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if flight, ok := cache.flights[reqURL]; ok {
+		return flight, false
+	}
+
+	flight = &Flight{
+		cache:      cache,
+		reqURL:     reqURL,
+		method:     method,
+		reqHeaders: reqHeaders.Clone(),
+		ready:      make(chan struct{}),
+	}
+	flight.cond = sync.NewCond(&flight.mu)
+	cache.flights[reqURL] = flight
+
+	return flight, true
+}
+
+// Start shares the response with the requests waiting on the flight. The body
+// of the response is replaced with one which copies the body for them as it is
+// read. A response which could not be cached for the request which started the
+// flight ends the flight instead so that its body is not copied. It must be
+// called before the response is changed for the client.
+func (flight *Flight) Start(resp *http.Response) {
+	ok, _ := flight.cache.cacheable(flight.reqURL, flight.method, flight.reqHeaders, resp)
+
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	if !ok {
+		flight.failLocked(errFlightUncacheable)
+		return
+	}
+	flight.resp = &http.Response{
+		StatusCode:        resp.StatusCode,
+		StatusDescription: resp.StatusDescription,
+		Headers:           resp.Headers.Clone(),
+		HTTPVer:           resp.HTTPVer,
+	}
+	body := &flightBody{flight: flight, body: resp.Body}
+	resp.Body = body
+	flight.source = body
+	flight.started = true
+	close(flight.ready)
+}
+
+// Fail ends the flight without a response. The waiting requests fetch the
+// response themselves.
+func (flight *Flight) Fail(err error) {
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	flight.failLocked(err)
+}
+
+// failLocked ends the flight with the error and releases the waiting requests.
+// The flight lock must be held.
+func (flight *Flight) failLocked(err error) {
+	flight.endLocked(err)
+	if !flight.started {
+		flight.started = true
+		close(flight.ready)
+	}
+}
+
+// Land ends the flight once the request which started it is finished with the
+// response. If other requests are still being sent the body, the rest of it is
+// read from the host server for them. The flight is ended under the same lock
+// which finds it has no followers so that no request joins it in between.
+func (flight *Flight) Land() {
+	flight.mu.Lock()
+	if !flight.started || flight.done || len(flight.readers) == 0 {
+		flight.failLocked(errFlightAbandoned)
+		flight.mu.Unlock()
+		return
+	}
+	flight.mu.Unlock()
+
+	_, err := io.Copy(ioutil.Discard, flight.source)
+	if err != nil {
+		flight.Fail(err)
+	}
+}
+
+// endLocked marks the body as complete and removes the flight so that new
+// requests no longer join it. The flight lock must be held.
+func (flight *Flight) endLocked(err error) {
+	if flight.done {
+		return
+	}
+	flight.done = true
+	flight.err = err
+	flight.cond.Broadcast()
+
+	flight.cache.mu.Lock()
+	if flight.cache.flights[flight.reqURL] == flight {
+		delete(flight.cache.flights, flight.reqURL)
+	}
+	flight.cache.mu.Unlock()
+}
+
+// Wait waits for the response of the flight and returns a copy of it which
+// reads the body as it streams. The ok result reports whether the response can
+// be shared with a request with the headers specified. The response can only
+// be shared if it could also be cached for this request once the rules are
+// applied and both requests select the same variant. The body of the response
+// must be closed so that the flight no longer keeps the body for it.
+func (flight *Flight) Wait(reqHeaders http.Headers) (resp *http.Response, ok bool) {
+	<-flight.ready
+
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	if flight.resp == nil || (flight.done && flight.err != nil) {
+		return &http.Response{}, false
+	}
+	// The start of the body is no longer kept or the window is already full.
+	if flight.base > 0 || int64(len(flight.body)) >= flight.cache.maxEntrySize {
+		return &http.Response{}, false
+	}
+	ok, _ = flight.cache.cacheable(flight.reqURL, flight.method, reqHeaders, flight.resp)
+	if !ok {
+		return &http.Response{}, false
+	}
+	vary := varyHeaders(flight.resp.Headers)
+	if varyKey(reqHeaders, vary) != varyKey(flight.reqHeaders, vary) {
+		return &http.Response{}, false
+	}
+
+	reader := &flightReader{flight: flight}
+	if flight.readers == nil {
+		flight.readers = map[*flightReader]bool{}
+	}
+	flight.readers[reader] = true
+	resp = &http.Response{
+		StatusCode:        flight.resp.StatusCode,
+		StatusDescription: flight.resp.StatusDescription,
+		Headers:           flight.resp.Headers.Clone(),
+		Body:              reader,
+		HTTPVer:           flight.resp.HTTPVer,
+	}
+
+	return resp, true
+}
+
+// flightBody copies the body of the response read by the request which started
+// the flight for the other requests.
+type flightBody struct {
+	flight *Flight
+	body   io.ReadCloser
+}
+
+func (flightBody *flightBody) Read(p []byte) (n int, err error) {
+	flight := flightBody.flight
+	maxSize := flight.cache.maxEntrySize
+
+	// Detach the requests a whole window behind to make room in the window.
+	flight.mu.Lock()
+	if !flight.done && len(flight.readers) > 0 {
+		flight.trimLocked()
+		if int64(len(flight.body)) >= maxSize {
+			for reader := range flight.readers {
+				if reader.offset <= flight.base {
+					reader.err = errFlightBehind
+					delete(flight.readers, reader)
+				}
+			}
+			flight.trimLocked()
+			flight.cond.Broadcast()
+		}
+	}
+	// A full window with no other request reading it ends the flight below.
+	if room := maxSize - int64(len(flight.body)); !flight.done && room > 0 &&
+		int64(len(p)) > room {
+		p = p[:room]
+	}
+	flight.mu.Unlock()
+
+	n, err = flightBody.body.Read(p)
+
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	// The body is no longer shared once the flight has ended.
+	if flight.done {
+		return n, err
+	}
+	flight.body = append(flight.body, p[:n]...)
+	flight.trimLocked()
+	if err == io.EOF {
+		flight.endLocked(nil)
+	} else if err != nil {
+		flight.endLocked(err)
+	} else if len(flight.readers) == 0 &&
+		flight.base+int64(len(flight.body)) > maxSize {
+		flight.body = nil
+		flight.endLocked(errFlightTooLarge)
+	}
+	flight.cond.Broadcast()
+
+	return n, err
+}
+
+func (flightBody *flightBody) Close() (err error) {
+	return flightBody.body.Close()
+}
+
+// trimLocked drops the bytes of the window which every request reading the
+// body has been sent. The window is kept from the start while no other request
+// reads the body so that requests can still join. The flight lock must be
+// held.
+func (flight *Flight) trimLocked() {
+	if len(flight.readers) == 0 {
+		return
+	}
+	start := flight.base + int64(len(flight.body))
+	for reader := range flight.readers {
+		if reader.offset < start {
+			start = reader.offset
+		}
+	}
+	flight.body = flight.body[start-flight.base:]
+	flight.base = start
+}
+
+// flightReader reads the body of a flight from the start, waiting for more of
+// it to arrive until it is complete. The error is set if the reader was
+// detached from the flight.
+type flightReader struct {
+	flight *Flight
+	offset int64
+	err    error
+}
+
+func (flightReader *flightReader) Read(p []byte) (n int, err error) {
+	flight := flightReader.flight
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	end := func() int64 { return flight.base + int64(len(flight.body)) }
+	for flightReader.err == nil && flightReader.offset >= end() && !flight.done {
+		flight.cond.Wait()
+	}
+	if flightReader.err != nil {
+		return 0, flightReader.err
+	}
+	if flightReader.offset < end() {
+		n = copy(p, flight.body[flightReader.offset-flight.base:])
+		flightReader.offset += int64(n)
+		return n, nil
+	}
+	if flight.err != nil {
+		return 0, flight.err
+	}
+
+	return 0, io.EOF
+}
+
+// Close stops the flight keeping the body for the reader.
+func (flightReader *flightReader) Close() (err error) {
+	flight := flightReader.flight
+	flight.mu.Lock()
+	defer flight.mu.Unlock()
+
+	delete(flight.readers, flightReader)
+
+	return nil
+}
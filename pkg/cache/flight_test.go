@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// newFlightResponse returns a cacheable response with the body.
+func newFlightResponse(body string) (resp *http.Response) {
+	return &http.Response{
+		StatusCode:        200,
+		StatusDescription: "OK",
+		Headers: http.Headers{
+			{Name: "Date", Value: time.Now().UTC().Format(http.TimeFormat)},
+			{Name: "Cache-Control", Value: "max-age=60"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+		HTTPVer: "HTTP/1.1",
+	}
+}
+
+// startTestFlight starts a flight for the URL with the body and joins it with
+// the number of followers specified. The response read by the leader and the
+// responses of the followers are returned.
+func startTestFlight(
+	t *testing.T,
+	cache *Cache,
+	reqURL string,
+	body string,
+	numFollowers int,
+) (flight *Flight, resp *http.Response, followers []*http.Response) {
+	flight, leader := cache.Join(reqURL, "GET", http.Headers{})
+	if !leader {
+		t.Fatal("Join() did not start a flight")
+	}
+	resp = newFlightResponse(body)
+	flight.Start(resp)
+
+	followers = make([]*http.Response, numFollowers)
+	for i := range followers {
+		joined, leader := cache.Join(reqURL, "GET", http.Headers{})
+		if leader || joined != flight {
+			t.Fatal("Join() did not join the flight in progress")
+		}
+		follower, ok := flight.Wait(http.Headers{})
+		if !ok {
+			t.Fatal("Wait() did not share the response")
+		}
+		followers[i] = follower
+	}
+
+	return flight, resp, followers
+}
+
+// TestFlightWindow checks that requests sharing a flight are sent the whole
+// body while no more than the maximum entry size of it is kept in memory. The
+// followers read each part of the body as soon as the leader has read it.
+func TestFlightWindow(t *testing.T) {
+	const maxEntrySize = 1024
+	const reqURL = "http://www.example.com/large"
+
+	cache := NewCache(NewMemoryStorage(0, nil), maxEntrySize)
+	body := strings.Repeat("0123456789", 10*maxEntrySize)
+	flight, resp, followers := startTestFlight(t, cache, reqURL, body, 4)
+
+	// A request which gives up early does not hold up the others.
+	early, ok := flight.Wait(http.Headers{})
+	if !ok {
+		t.Fatal("Wait() did not share the response before the window filled")
+	}
+	early.Body.Close()
+
+	var sent bytes.Buffer
+	received := make([]bytes.Buffer, len(followers))
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		sent.Write(buf[:n])
+		flight.mu.Lock()
+		kept := len(flight.body)
+		flight.mu.Unlock()
+		if kept > maxEntrySize {
+			t.Fatalf("flight keeps %d bytes, want at most %d", kept, maxEntrySize)
+		}
+		for i, follower := range followers {
+			for received[i].Len() < sent.Len() {
+				n, err := follower.Body.Read(buf)
+				if err != nil {
+					t.Fatalf("follower %d read error: %s", i, err)
+				}
+				received[i].Write(buf[:n])
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("leader read error: %s", err)
+		}
+	}
+	flight.Land()
+
+	if sent.String() != body {
+		t.Errorf("leader read %d bytes, want %d", sent.Len(), len(body))
+	}
+	for i, follower := range followers {
+		if n, err := follower.Body.Read(buf); n != 0 || err != io.EOF {
+			t.Errorf("follower %d read %d bytes, %v after the body, want EOF", i, n, err)
+		}
+		follower.Body.Close()
+		if received[i].String() != body {
+			t.Errorf("follower %d read %d bytes, want %d", i, received[i].Len(), len(body))
+		}
+	}
+	if _, ok := flight.Wait(http.Headers{}); ok {
+		t.Error("Wait() shared a response whose start is no longer kept")
+	}
+}
+
+// TestFlightDetachesSlowFollower checks that the leader reads the whole body
+// without waiting for a follower which stops reading, and that the follower
+// fails once it has fallen a whole window behind.
+func TestFlightDetachesSlowFollower(t *testing.T) {
+	const maxEntrySize = 1024
+	const reqURL = "http://www.example.com/slow"
+
+	cache := NewCache(NewMemoryStorage(0, nil), maxEntrySize)
+	body := strings.Repeat("0123456789", 10*maxEntrySize)
+	flight, resp, followers := startTestFlight(t, cache, reqURL, body, 1)
+	slow := followers[0]
+	defer slow.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("leader read error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader is waiting for the follower which stopped reading")
+	}
+	flight.Land()
+
+	if _, err := ioutil.ReadAll(slow.Body); err != errFlightBehind {
+		t.Errorf("follower read error = %v, want %v", err, errFlightBehind)
+	}
+}
+
+// TestFlightLandAbandoned checks that a flight which no other request joined
+// ends when the request which started it is finished.
+func TestFlightLandAbandoned(t *testing.T) {
+	const reqURL = "http://www.example.com/abandoned"
+
+	cache := NewCache(NewMemoryStorage(0, nil), 1024)
+	flight, _ := cache.Join(reqURL, "GET", http.Headers{})
+	flight.Start(newFlightResponse("abandoned"))
+	flight.Land()
+
+	if _, ok := flight.Wait(http.Headers{}); ok {
+		t.Error("Wait() shared the response of an abandoned flight")
+	}
+	if _, leader := cache.Join(reqURL, "GET", http.Headers{}); !leader {
+		t.Error("Join() joined an abandoned flight")
+	}
+}
+
+// TestFlightStartUncacheable checks that a response which could not be cached
+// ends the flight at once rather than having its body copied.
+func TestFlightStartUncacheable(t *testing.T) {
+	const reqURL = "http://www.example.com/private"
+
+	cache := NewCache(NewMemoryStorage(0, nil), 1024)
+	flight, _ := cache.Join(reqURL, "GET", http.Headers{})
+	resp := newFlightResponse("private")
+	resp.Headers.Set("Cache-Control", "no-store")
+	flight.Start(resp)
+
+	if _, ok := resp.Body.(*flightBody); ok {
+		t.Error("Start() copies the body of a response which can't be cached")
+	}
+	if _, ok := flight.Wait(http.Headers{}); ok {
+		t.Error("Wait() shared a response which can't be cached")
+	}
+	if _, leader := cache.Join(reqURL, "GET", http.Headers{}); !leader {
+		t.Error("Join() joined a flight whose response can't be cached")
+	}
+	flight.Land()
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// maxDeltaSeconds is the largest delta-seconds value. Larger values are
+// treated as this value as recommended by RFC 7234 section 1.2.1.
+const maxDeltaSeconds = 1<<31 - 1
+
+// heuristicFraction is the fraction of the time since the response was last
+// modified which it is considered fresh for without explicit freshness
+// information.
+const heuristicFraction = 10
+
+// heuristicWarningAge is the age after which a heuristically fresh response is
+// served with a warning.
+const heuristicWarningAge = 24 * time.Hour
+
+// staleIfErrorStatusCodes are the status codes which allow a stale response to
+// be served as defined by RFC 5861 section 4.
+var staleIfErrorStatusCodes = map[int]bool{
+	500: true,
+	502: true,
+	503: true,
+	504: true,
+}
+
+// heuristicallyCacheable are the status codes which can be given a heuristic
+// freshness lifetime as defined by RFC 7231 section 6.1.
+var heuristicallyCacheable = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	206: true,
+	300: true,
+	301: true,
+	404: true,
+	405: true,
+	410: true,
+	414: true,
+	501: true,
+}
+
+// parseDeltaSeconds parses a delta-seconds value. The ok result indicates
+// whether the value is valid.
+func parseDeltaSeconds(value string) (delta time.Duration, ok bool) {
+	if value == "" || strings.TrimLeft(value, "0123456789") != "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// dateValue returns the value of the Date header. The response time is used
+// if the header is missing or invalid.
+func dateValue(headers http.Headers, responseTime time.Time) (date time.Time) {
+	date, err := http.ParseTime(headers.Get("Date"))
+	if err != nil {
+		return responseTime
+	}
+
+	return date
+}
+
+// FreshnessLifetime returns how long a response is fresh for after it was
+// generated by the host server as defined by RFC 7234 section 4.2.1. The
+// s-maxage and max-age directives take priority over the Expires header. A
+// heuristic lifetime based on the Last-Modified header is used if there is no
+// explicit lifetime. The heuristic result indicates whether the lifetime is
+// heuristic.
+func FreshnessLifetime(
+	resp *http.Response,
+	responseTime time.Time,
+) (lifetime time.Duration, heuristic bool) {
+	headers := resp.Headers
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := headers.CacheControlDirective(directive); ok {
+			// Invalid values are treated as stale.
+			lifetime, _ = parseDeltaSeconds(value)
+			return lifetime, false
+		}
+	}
+
+	date := dateValue(headers, responseTime)
+	if headers.Has("Expires") {
+		// Invalid dates such as 0 represent a time in the past.
+		expires, err := http.ParseTime(headers.Get("Expires"))
+		if err != nil || expires.Before(date) {
+			return 0, false
+		}
+		return expires.Sub(date), false
+	}
+
+	// Explicitly public responses can be given a heuristic lifetime regardless
+	// of the status code.
+	_, public := headers.CacheControlDirective("public")
+	if !heuristicallyCacheable[resp.StatusCode] && !public {
+		return 0, false
+	}
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil || lastModified.After(date) {
+		return 0, false
+	}
+
+	return date.Sub(lastModified) / heuristicFraction, true
+}
+
+// CurrentAge returns the age of the cached response as defined by RFC 7234
+// section 4.2.3. The age includes the time the response spent in other caches,
+// the time it took to arrive and the time it has been stored for.
+func (entry *Entry) CurrentAge(now time.Time) (age time.Duration) {
+	headers := entry.Response.Headers
+	apparentAge := entry.ResponseTime.Sub(dateValue(headers, entry.ResponseTime))
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	ageValue, _ := parseDeltaSeconds(headers.Get("Age"))
+	responseDelay := entry.ResponseTime.Sub(entry.RequestTime)
+	correctedAgeValue := ageValue + responseDelay
+
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	residentTime := now.Sub(entry.ResponseTime)
+
+	return correctedInitialAge + residentTime
+}
+
+// FreshnessLifetime returns how long the cached response is fresh for. The
+// lifetime set by a Rule takes priority over the response headers. The
+// heuristic result indicates whether the lifetime is heuristic.
+func (entry *Entry) FreshnessLifetime() (lifetime time.Duration, heuristic bool) {
+	if entry.Lifetime != 0 {
+		return entry.Lifetime, false
+	}
+
+	return FreshnessLifetime(entry.Response, entry.ResponseTime)
+}
+
+// TimeToLive returns how long the cached response remains fresh for. A
+// negative duration is returned if the response is stale.
+func (entry *Entry) TimeToLive(now time.Time) (ttl time.Duration) {
+	lifetime, _ := entry.FreshnessLifetime()
+
+	return lifetime - entry.CurrentAge(now)
+}
+
+// expiresAt returns when the cached response becomes stale.
+func (entry *Entry) expiresAt() (expires time.Time) {
+	return entry.ResponseTime.Add(entry.TimeToLive(entry.ResponseTime))
+}
+
+// mustRevalidate reports whether the host server forbids serving the cached
+// response once it is stale as defined by RFC 7234 section 4.2.4.
+func (entry *Entry) mustRevalidate() bool {
+	for _, directive := range []string{
+		"must-revalidate",
+		"proxy-revalidate",
+		"no-cache",
+	} {
+		if _, ok := entry.Response.Headers.CacheControlDirective(directive); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removableAt returns when the stale cached response can no longer be used. A
+// response without validators can't be revalidated, so once it is past its
+// stale-while-revalidate and stale-if-error windows and the maxStale the proxy
+// serves stale responses for in place of errors it can only be replaced. The
+// ok result is false if the response has validators.
+func (entry *Entry) removableAt(maxStale time.Duration) (at time.Time, ok bool) {
+	if entry.ETag != "" || entry.LastModified != "" {
+		return time.Time{}, false
+	}
+	if entry.mustRevalidate() {
+		return entry.Expires, true
+	}
+
+	window := maxStale
+	for _, directive := range []string{"stale-while-revalidate", "stale-if-error"} {
+		value, ok := entry.Response.Headers.CacheControlDirective(directive)
+		if !ok {
+			continue
+		}
+		if delta, ok := parseDeltaSeconds(value); ok && delta > window {
+			window = delta
+		}
+	}
+
+	return entry.Expires.Add(window), true
+}
+
+// staleWithin reports whether the cached response has been stale for no longer
+// than the delta-seconds value of the directive.
+func (entry *Entry) staleWithin(directive string, now time.Time) bool {
+	value, ok := entry.Response.Headers.CacheControlDirective(directive)
+	if !ok {
+		return false
+	}
+	window, ok := parseDeltaSeconds(value)
+
+	return ok && now.Sub(entry.Expires) <= window
+}
+
+// StaleWhileRevalidate reports whether the stale cached response can be served
+// while it is revalidated in the background as defined by RFC 5861 section 3.
+// Requests which set their own limits on freshness are not served stale.
+func (entry *Entry) StaleWhileRevalidate(
+	reqHeaders http.Headers,
+	now time.Time,
+) bool {
+	return !constrainsFreshness(reqHeaders) && !entry.mustRevalidate() &&
+		entry.staleWithin("stale-while-revalidate", now)
+}
+
+// StaleIfError reports whether the stale cached response can be served in
+// place of an error as defined by RFC 5861 section 4. A status code of 0 means
+// the host server could not be reached. The response can be served for maxStale
+// after it becomes stale regardless of the stale-if-error directive.
+func (entry *Entry) StaleIfError(
+	now time.Time,
+	statusCode int,
+	maxStale time.Duration,
+) bool {
+	if statusCode != 0 && !staleIfErrorStatusCodes[statusCode] {
+		return false
+	}
+	if entry.mustRevalidate() {
+		return false
+	}
+
+	return entry.staleWithin("stale-if-error", now) ||
+		(maxStale > 0 && now.Sub(entry.Expires) <= maxStale)
+}
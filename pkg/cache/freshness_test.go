@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// testTime is the time the host server generated the responses in the tests.
+var testTime = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// testDate formats the time the offset after testTime as a HTTP date.
+func testDate(offset time.Duration) string {
+	return testTime.Add(offset).Format(http.TimeFormat)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		headers    http.Headers
+		lifetime   time.Duration
+		heuristic  bool
+	}{
+		{
+			name:       "max-age",
+			statusCode: 200,
+			headers:    http.Headers{{Name: "Cache-Control", Value: "max-age=60"}},
+			lifetime:   60 * time.Second,
+		},
+		{
+			name:       "s-maxage takes priority over max-age",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "max-age=60, s-maxage=120"},
+			},
+			lifetime: 120 * time.Second,
+		},
+		{
+			name:       "max-age takes priority over Expires",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Expires", Value: testDate(time.Hour)},
+				{Name: "Cache-Control", Value: "max-age=60"},
+			},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:       "invalid max-age is stale",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "max-age=soon"},
+				{Name: "Expires", Value: testDate(time.Hour)},
+			},
+			lifetime: 0,
+		},
+		{
+			name:       "negative max-age is stale",
+			statusCode: 200,
+			headers:    http.Headers{{Name: "Cache-Control", Value: "max-age=-1"}},
+			lifetime:   0,
+		},
+		{
+			name:       "max-age larger than the largest delta-seconds",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "max-age=99999999999"},
+			},
+			lifetime: maxDeltaSeconds * time.Second,
+		},
+		{
+			name:       "Expires compared with Date",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(-time.Hour)},
+				{Name: "Expires", Value: testDate(time.Hour)},
+			},
+			lifetime: 2 * time.Hour,
+		},
+		{
+			name:       "Expires compared with the response time without Date",
+			statusCode: 200,
+			headers:    http.Headers{{Name: "Expires", Value: testDate(time.Hour)}},
+			lifetime:   time.Hour,
+		},
+		{
+			name:       "Expires before Date",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Expires", Value: testDate(-time.Hour)},
+			},
+			lifetime: 0,
+		},
+		{
+			name:       "Expires 0",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Expires", Value: "0"},
+			},
+			lifetime: 0,
+		},
+		{
+			name:       "heuristic lifetime from Last-Modified",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Last-Modified", Value: testDate(-10 * time.Hour)},
+			},
+			lifetime:  time.Hour,
+			heuristic: true,
+		},
+		{
+			name:       "Last-Modified after Date",
+			statusCode: 200,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Last-Modified", Value: testDate(time.Hour)},
+			},
+			lifetime: 0,
+		},
+		{
+			name:       "no freshness information",
+			statusCode: 200,
+			headers:    http.Headers{{Name: "Date", Value: testDate(0)}},
+			lifetime:   0,
+		},
+		{
+			name:       "status code not cacheable by default",
+			statusCode: 302,
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Last-Modified", Value: testDate(-10 * time.Hour)},
+			},
+			lifetime: 0,
+		},
+		{
+			name:       "public status code not cacheable by default",
+			statusCode: 302,
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "public"},
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Last-Modified", Value: testDate(-10 * time.Hour)},
+			},
+			lifetime:  time.Hour,
+			heuristic: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.statusCode, Headers: test.headers}
+			lifetime, heuristic := FreshnessLifetime(resp, testTime)
+			if lifetime != test.lifetime || heuristic != test.heuristic {
+				t.Errorf(
+					"FreshnessLifetime() = %s, %t, want %s, %t",
+					lifetime,
+					heuristic,
+					test.lifetime,
+					test.heuristic,
+				)
+			}
+		})
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      http.Headers
+		requestTime  time.Time
+		responseTime time.Time
+		now          time.Time
+		age          time.Duration
+	}{
+		{
+			name:         "resident time",
+			headers:      http.Headers{{Name: "Date", Value: testDate(0)}},
+			requestTime:  testTime,
+			responseTime: testTime,
+			now:          testTime.Add(30 * time.Second),
+			age:          30 * time.Second,
+		},
+		{
+			name:         "apparent age from Date",
+			headers:      http.Headers{{Name: "Date", Value: testDate(-10 * time.Second)}},
+			requestTime:  testTime,
+			responseTime: testTime,
+			now:          testTime.Add(5 * time.Second),
+			age:          15 * time.Second,
+		},
+		{
+			name: "Age combined with response delay",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Age", Value: "20"},
+			},
+			requestTime:  testTime.Add(-2 * time.Second),
+			responseTime: testTime,
+			now:          testTime.Add(5 * time.Second),
+			age:          27 * time.Second,
+		},
+		{
+			name: "apparent age larger than corrected Age",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(-time.Minute)},
+				{Name: "Age", Value: "20"},
+			},
+			requestTime:  testTime.Add(-2 * time.Second),
+			responseTime: testTime,
+			now:          testTime,
+			age:          time.Minute,
+		},
+		{
+			name:         "Date after the response time",
+			headers:      http.Headers{{Name: "Date", Value: testDate(time.Minute)}},
+			requestTime:  testTime,
+			responseTime: testTime,
+			now:          testTime.Add(time.Second),
+			age:          time.Second,
+		},
+		{
+			name: "invalid Age",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Age", Value: "old"},
+			},
+			requestTime:  testTime,
+			responseTime: testTime,
+			now:          testTime.Add(time.Second),
+			age:          time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := &Entry{
+				Response:     &http.Response{StatusCode: 200, Headers: test.headers},
+				RequestTime:  test.requestTime,
+				ResponseTime: test.responseTime,
+			}
+			age := entry.CurrentAge(test.now)
+			if age != test.age {
+				t.Errorf("CurrentAge() = %s, want %s", age, test.age)
+			}
+		})
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  http.Headers
+		lifetime time.Duration
+		expires  time.Time
+	}{
+		{
+			name: "max-age",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Cache-Control", Value: "max-age=60"},
+			},
+			expires: testTime.Add(60 * time.Second),
+		},
+		{
+			name: "max-age less the age when received",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Cache-Control", Value: "max-age=60"},
+				{Name: "Age", Value: "10"},
+			},
+			expires: testTime.Add(50 * time.Second),
+		},
+		{
+			name: "already stale",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Cache-Control", Value: "max-age=60"},
+				{Name: "Age", Value: "90"},
+			},
+			expires: testTime.Add(-30 * time.Second),
+		},
+		{
+			name: "Expires",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(-time.Minute)},
+				{Name: "Expires", Value: testDate(time.Hour)},
+			},
+			expires: testTime.Add(time.Hour),
+		},
+		{
+			name: "lifetime set by a rule",
+			headers: http.Headers{
+				{Name: "Date", Value: testDate(0)},
+				{Name: "Cache-Control", Value: "no-store"},
+			},
+			lifetime: time.Hour,
+			expires:  testTime.Add(time.Hour),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := &Entry{
+				Response:     &http.Response{StatusCode: 200, Headers: test.headers},
+				Lifetime:     test.lifetime,
+				RequestTime:  testTime,
+				ResponseTime: testTime,
+			}
+			expires := entry.expiresAt()
+			if !expires.Equal(test.expires) {
+				t.Errorf("expiresAt() = %s, want %s", expires, test.expires)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// List returns the cached URLs on the host along with the number of variants
+// stored for each URL. Every URL is listed if the host is empty.
+func (cache *Cache) List(host string) (list string) {
+	var builder strings.Builder
+
+	lines := []string{}
+	err := cache.storage.Range(func(reqURL string, numVariants int) bool {
+		if host == "" || onHost(reqURL, host) {
+			lines = append(lines, fmt.Sprintf("%q: %d variants", reqURL, numVariants))
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Sprintf("cache: %s", err)
+	}
+
+	prefix := ""
+	if host == "" {
+		fmt.Fprintf(&builder, "%scache: %d URLs\n", prefix, len(lines))
+	} else {
+		fmt.Fprintf(&builder, "%scache: %d URLs on %q\n", prefix, len(lines), host)
+	}
+	prefix = "   "
+	for _, line := range lines {
+		fmt.Fprintf(&builder, "%s - %s\n", prefix, line)
+	}
+
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// Show returns the details of every cached variant of the URL. The headers,
+// size, age, freshness lifetime, validators and number of hits of each variant
+// are shown.
+func (cache *Cache) Show(reqURL string) (details string) {
+	var builder strings.Builder
+
+	entries, err := cache.storage.Variants(reqURL)
+	if err != nil {
+		return fmt.Sprintf("cache: %s", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("cache: %q is not cached", reqURL)
+	}
+
+	now := time.Now()
+	prefix := ""
+	fmt.Fprintf(&builder, "%scache: %q: %d variants\n", prefix, reqURL, len(entries))
+	for _, entry := range entries {
+		prefix = "   "
+		variant := "all requests"
+		if len(entry.Vary) > 0 {
+			variant = strings.ReplaceAll(strings.TrimSpace(entry.VaryKey), "\n", "; ")
+		}
+		fmt.Fprintf(&builder, "%s - variant: %s\n", prefix, variant)
+
+		prefix = "        "
+		lifetime, heuristic := entry.FreshnessLifetime()
+		heuristicMessage := ""
+		if heuristic {
+			heuristicMessage = " (heuristic)"
+		} else if entry.Lifetime != 0 {
+			heuristicMessage = " (rule)"
+		}
+		freshness := "fresh"
+		if !now.Before(entry.Expires) {
+			freshness = "stale"
+		}
+		cache.mu.Lock()
+		hits := cache.hits[reqURL][variantID(reqURL, entry.Vary, entry.VaryKey)]
+		cache.mu.Unlock()
+
+		fmt.Fprintf(&builder, "%s - size: %d bytes\n", prefix, entry.Size())
+		fmt.Fprintf(&builder, "%s - age: %s\n", prefix, entry.CurrentAge(now).Round(time.Second))
+		fmt.Fprintf(&builder, "%s - freshness lifetime: %s%s\n", prefix, lifetime, heuristicMessage)
+		fmt.Fprintf(&builder, "%s - expires: %s (%s)\n", prefix, entry.Expires.Format(time.RFC1123), freshness)
+		fmt.Fprintf(&builder, "%s - etag: %s\n", prefix, entry.ETag)
+		fmt.Fprintf(&builder, "%s - last modified: %s\n", prefix, entry.LastModified)
+		fmt.Fprintf(&builder, "%s - hits: %d\n", prefix, hits)
+		fmt.Fprintf(&builder, "%s - headers:\n", prefix)
+		prefix = "             "
+		head := strings.TrimRight(entry.Response.String(), "\r\n")
+		for _, line := range strings.Split(head, "\r\n") {
+			fmt.Fprintf(&builder, "%s%s\n", prefix, line)
+		}
+	}
+
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// Summary returns the number and size of the cached responses along with the
+// number of requests answered from the cache and forwarded to the host server.
+func (cache *Cache) Summary() (summary string) {
+	var builder strings.Builder
+
+	stats, err := cache.storage.Stats()
+	if err != nil {
+		return fmt.Sprintf("cache: %s", err)
+	}
+	cache.mu.Lock()
+	hits, misses := cache.numHits, cache.numMisses
+	cache.mu.Unlock()
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	prefix := ""
+	fmt.Fprintf(&builder, "%scache stats:\n", prefix)
+	prefix = "   "
+	fmt.Fprintf(&builder, "%s - entries: %d\n", prefix, stats.Entries)
+	fmt.Fprintf(&builder, "%s - size: %d bytes\n", prefix, stats.Size)
+	fmt.Fprintf(&builder, "%s - hits: %d\n", prefix, hits)
+	fmt.Fprintf(&builder, "%s - misses: %d\n", prefix, misses)
+	fmt.Fprintf(&builder, "%s - hit ratio: %.1f%%\n", prefix, 100*hitRatio)
+
+	return strings.TrimRight(builder.String(), "\n")
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// MemoryStorage is a Storage which keeps responses in memory. The responses are
+// kept in least recently used order so that the oldest can be evicted once the
+// storage is full.
+type MemoryStorage struct {
+	maxSize  int64
+	onEvict  func(reqURL string, entry *Entry)
+	evicted  func(reqURL string, id string)
+	mu       sync.Mutex
+	cacheMap map[string]*variants
+	lru      *list.List
+	size     int64
+}
+
+// NewMemoryStorage returns a new MemoryStorage which holds at most maxSize
+// bytes of responses. A limit of 0 allows any size. The onEvict function is
+// called with each response evicted to stay within the limit, it may be nil.
+func NewMemoryStorage(
+	maxSize int64,
+	onEvict func(reqURL string, entry *Entry),
+) (storage *MemoryStorage) {
+	storage = &MemoryStorage{
+		maxSize:  maxSize,
+		onEvict:  onEvict,
+		cacheMap: make(map[string]*variants),
+		lru:      list.New(),
+	}
+
+	return storage
+}
+
+// Get returns the variant of the URL selected by the request headers. The
+// variant becomes the most recently used response.
+func (storage *MemoryStorage) Get(
+	reqURL string,
+	reqHeaders http.Headers,
+) (entry *Entry, ok bool, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	variants, ok := storage.cacheMap[reqURL]
+	if !ok {
+		return &Entry{}, false, nil
+	}
+	entry, ok = variants.get(reqHeaders)
+	if ok {
+		storage.lru.MoveToFront(entry.element)
+	}
+
+	return entry, ok, nil
+}
+
+// Variants returns every variant of the URL.
+func (storage *MemoryStorage) Variants(reqURL string) (entries []*Entry, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	entries = []*Entry{}
+	if variants, ok := storage.cacheMap[reqURL]; ok {
+		entries = append(entries, variants.entries...)
+	}
+
+	return entries, nil
+}
+
+// Put stores the entry as the most recently used response and evicts the least
+// recently used responses until the storage is within its size limit.
+// Responses larger than the limit are not stored.
+func (storage *MemoryStorage) Put(reqURL string, entry *Entry) (err error) {
+	size := int64(len(entry.Response.String()) + len(entry.Body))
+	if storage.maxSize > 0 && size > storage.maxSize {
+		return nil
+	}
+
+	storage.mu.Lock()
+	variants, ok := storage.cacheMap[reqURL]
+	if !ok {
+		variants = newVariants()
+		storage.cacheMap[reqURL] = variants
+	}
+	// The entry itself is replaced if it is already stored.
+	for _, replaced := range variants.put(entry) {
+		storage.lru.Remove(replaced.element)
+		storage.size -= replaced.size
+	}
+	entry.reqURL = reqURL
+	entry.size = size
+	entry.element = storage.lru.PushFront(entry)
+	storage.size += size
+
+	evicted := []*Entry{}
+	for storage.maxSize > 0 && storage.size > storage.maxSize {
+		oldest := storage.lru.Back().Value.(*Entry)
+		storage.removeLocked(oldest)
+		evicted = append(evicted, oldest)
+	}
+	storage.mu.Unlock()
+
+	for _, entry := range evicted {
+		if storage.onEvict != nil {
+			storage.onEvict(entry.reqURL, entry)
+		}
+		if storage.evicted != nil {
+			storage.evicted(
+				entry.reqURL,
+				variantID(entry.reqURL, entry.Vary, entry.VaryKey),
+			)
+		}
+	}
+
+	return nil
+}
+
+// setEvicted sets the function called with the URL and variant ID of each
+// response evicted.
+func (storage *MemoryStorage) setEvicted(evicted func(reqURL string, id string)) {
+	storage.evicted = evicted
+}
+
+// removeLocked removes the entry from the storage. The storage lock must be
+// held.
+func (storage *MemoryStorage) removeLocked(entry *Entry) {
+	storage.lru.Remove(entry.element)
+	storage.size -= entry.size
+
+	variants := storage.cacheMap[entry.reqURL]
+	variants.remove(entry)
+	if variants.len() == 0 {
+		delete(storage.cacheMap, entry.reqURL)
+	}
+}
+
+// Delete removes every variant of the URL.
+func (storage *MemoryStorage) Delete(reqURL string) (freed Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	variants, ok := storage.cacheMap[reqURL]
+	if !ok {
+		return Stats{}, nil
+	}
+	for _, entry := range variants.entries {
+		storage.lru.Remove(entry.element)
+		storage.size -= entry.size
+		freed.Entries++
+		freed.Size += entry.size
+	}
+	delete(storage.cacheMap, reqURL)
+
+	return freed, nil
+}
+
+// DeleteVariant removes the variant of the URL with the variant ID.
+func (storage *MemoryStorage) DeleteVariant(
+	reqURL string,
+	id string,
+) (freed Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	variants, ok := storage.cacheMap[reqURL]
+	if !ok {
+		return Stats{}, nil
+	}
+	for _, entry := range variants.entries {
+		if variantID(reqURL, entry.Vary, entry.VaryKey) == id {
+			storage.removeLocked(entry)
+			return Stats{Entries: 1, Size: entry.size}, nil
+		}
+	}
+
+	return Stats{}, nil
+}
+
+// Range calls f with each URL and the number of variants stored for it. The
+// URLs are copied first so f may use the storage.
+func (storage *MemoryStorage) Range(
+	f func(reqURL string, numVariants int) bool,
+) (err error) {
+	storage.mu.Lock()
+	numVariants := make(map[string]int, len(storage.cacheMap))
+	for reqURL, variants := range storage.cacheMap {
+		numVariants[reqURL] = variants.len()
+	}
+	storage.mu.Unlock()
+
+	for reqURL, n := range numVariants {
+		if !f(reqURL, n) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the number and size of the responses in memory.
+func (storage *MemoryStorage) Stats() (stats Stats, err error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return Stats{Entries: storage.lru.Len(), Size: storage.size}, nil
+}
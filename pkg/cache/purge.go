@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Purge removes every variant of the URL and returns the number and size of
+// the responses freed.
+func (cache *Cache) Purge(reqURL string) (freed Stats, err error) {
+	return cache.delete(reqURL)
+}
+
+// PurgeHost removes the responses of every URL on the host and returns the
+// number and size of the responses freed. A host without a port matches the
+// host on any port.
+func (cache *Cache) PurgeHost(host string) (freed Stats, err error) {
+	return cache.purgeMatching(func(reqURL string) bool {
+		return onHost(reqURL, host)
+	})
+}
+
+// onHost reports whether the URL is on the host. A host without a port matches
+// the host on any port.
+func onHost(reqURL string, host string) bool {
+	parsedURL, err := url.Parse(reqURL)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(parsedURL.Host, host) ||
+		strings.EqualFold(parsedURL.Hostname(), host)
+}
+
+// PurgePrefix removes the responses of every URL which starts with the prefix
+// and returns the number and size of the responses freed.
+func (cache *Cache) PurgePrefix(prefix string) (freed Stats, err error) {
+	return cache.purgeMatching(func(reqURL string) bool {
+		return strings.HasPrefix(reqURL, prefix)
+	})
+}
+
+// purgeMatching removes the responses of every URL which match reports true
+// for. The URLs are found before any are removed so the storage is not changed
+// while it is being iterated over.
+func (cache *Cache) purgeMatching(match func(reqURL string) bool) (freed Stats, err error) {
+	reqURLs := []string{}
+	err = cache.storage.Range(func(reqURL string, numVariants int) bool {
+		if match(reqURL) {
+			reqURLs = append(reqURLs, reqURL)
+		}
+		return true
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	for _, reqURL := range reqURLs {
+		urlFreed, err := cache.delete(reqURL)
+		freed.Entries += urlFreed.Entries
+		freed.Size += urlFreed.Size
+		if err != nil {
+			return freed, err
+		}
+	}
+
+	return freed, nil
+}
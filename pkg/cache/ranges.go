@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// NewRangeResponse returns a new Response for a request with the method and
+// headers specified as defined by RFC 7233. A GET request with a Range header
+// is answered with the ranges of the cached body it asks for. A single range is
+// sent as a 206 Partial Content response and several ranges as a
+// multipart/byteranges body. A 416 Range Not Satisfiable response is returned
+// if none of the ranges are in the body. The whole response is returned if the
+// Range header is invalid, asks for more bytes than the body holds or the
+// If-Range header does not match the entry.
+func (entry *Entry) NewRangeResponse(
+	method string,
+	reqHeaders http.Headers,
+) (resp *http.Response) {
+	resp = entry.NewResponse()
+	if method != "GET" || !reqHeaders.Has("Range") || resp.StatusCode != 200 ||
+		!entry.ifRangeMatches(reqHeaders) {
+		return resp
+	}
+
+	size := int64(len(entry.Body))
+	ranges, err := http.ParseRange(reqHeaders.Get("Range"), size)
+	if err == http.ErrUnsatisfiableRange {
+		resp.StatusCode = 416
+		resp.StatusDescription = "Range Not Satisfiable"
+		resp.Headers.Del("Content-Type")
+		resp.Headers.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		resp.Headers.Set("Content-Length", "0")
+		resp.Body = http.NoBody
+		return resp
+	} else if err != nil {
+		return resp
+	}
+
+	resp.StatusCode = 206
+	resp.StatusDescription = "Partial Content"
+	if len(ranges) == 1 {
+		byteRange := ranges[0]
+		body := entry.Body[byteRange.Start : byteRange.Start+byteRange.Length]
+		resp.Headers.Set("Content-Range", byteRange.ContentRange(size))
+		resp.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp
+	}
+
+	// Only the boundaries and part headers are written by the multipart writer.
+	// The parts are read from the cached body so that they are not copied.
+	var boundary bytes.Buffer
+	writer := multipart.NewWriter(&boundary)
+	parts := []io.Reader{}
+	length := int64(0)
+	for _, byteRange := range ranges {
+		partHeaders := textproto.MIMEHeader{}
+		if contentType := resp.Headers.Get("Content-Type"); contentType != "" {
+			partHeaders.Set("Content-Type", contentType)
+		}
+		partHeaders.Set("Content-Range", byteRange.ContentRange(size))
+		writer.CreatePart(partHeaders)
+		body := entry.Body[byteRange.Start : byteRange.Start+byteRange.Length]
+		parts = append(parts, strings.NewReader(boundary.String()), bytes.NewReader(body))
+		length += int64(boundary.Len()) + byteRange.Length
+		boundary.Reset()
+	}
+	writer.Close()
+	parts = append(parts, strings.NewReader(boundary.String()))
+	length += int64(boundary.Len())
+	resp.Headers.Set(
+		"Content-Type",
+		"multipart/byteranges; boundary="+writer.Boundary(),
+	)
+	resp.Headers.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.Body = ioutil.NopCloser(io.MultiReader(parts...))
+
+	return resp
+}
+
+// ifRangeMatches reports whether the ranges of a request can be served from the
+// entry. An If-Range header holding an entity tag must match the strong ETag of
+// the entry and one holding a date must match its Last-Modified date as
+// defined by RFC 7233 section 3.2. Requests without an If-Range header always
+// match.
+func (entry *Entry) ifRangeMatches(reqHeaders http.Headers) bool {
+	ifRange := strings.TrimSpace(reqHeaders.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return !strings.HasPrefix(entry.ETag, "W/") && ifRange == entry.ETag
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(entry.LastModified)
+	if err != nil || !date.Equal(lastModified) {
+		return false
+	}
+	// A Last-Modified date is only a strong validator if the response was sent
+	// at least a second later.
+	sent := dateValue(entry.Response.Headers, entry.ResponseTime)
+
+	return sent.Sub(lastModified) >= time.Second
+}
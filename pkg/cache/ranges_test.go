@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+func TestNewRangeResponse(t *testing.T) {
+	const body = "0123456789abcdefghijklmnopqrstuvwxyz"
+	type part struct {
+		contentRange string
+		body         string
+	}
+	tests := []struct {
+		name       string
+		method     string
+		rangeValue string
+		ifRange    string
+		statusCode int
+		// contentRange and body are checked for a response which is not
+		// multipart.
+		contentRange string
+		body         string
+		parts        []part
+	}{
+		{
+			name:       "no Range header",
+			statusCode: 200,
+			body:       body,
+		},
+		{
+			name:         "single range",
+			rangeValue:   "bytes=10-15",
+			statusCode:   206,
+			contentRange: "bytes 10-15/36",
+			body:         "abcdef",
+		},
+		{
+			name:       "several ranges",
+			rangeValue: "bytes=30-,0-1",
+			statusCode: 206,
+			parts: []part{
+				{"bytes 0-1/36", "01"},
+				{"bytes 30-35/36", "uvwxyz"},
+			},
+		},
+		{
+			name:         "overlapping ranges",
+			rangeValue:   "bytes=0-5,3-9",
+			statusCode:   206,
+			contentRange: "bytes 0-9/36",
+			body:         "0123456789",
+		},
+		{
+			name:       "ranges larger than the body",
+			rangeValue: "bytes=0-,0-",
+			statusCode: 200,
+			body:       body,
+		},
+		{
+			name:         "unsatisfiable",
+			rangeValue:   "bytes=100-",
+			statusCode:   416,
+			contentRange: "bytes */36",
+		},
+		{
+			name:       "invalid",
+			rangeValue: "bytes=9-0",
+			statusCode: 200,
+			body:       body,
+		},
+		{
+			name:         "If-Range matches",
+			rangeValue:   "bytes=0-0",
+			ifRange:      `"v1"`,
+			statusCode:   206,
+			contentRange: "bytes 0-0/36",
+			body:         "0",
+		},
+		{
+			name:       "If-Range does not match",
+			rangeValue: "bytes=0-0",
+			ifRange:    `"v2"`,
+			statusCode: 200,
+			body:       body,
+		},
+		{
+			name:       "HEAD",
+			method:     "HEAD",
+			rangeValue: "bytes=0-0",
+			statusCode: 200,
+			body:       body,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := newTestEntry(body, []string{}, http.Headers{})
+			entry.Response.Headers.Set("Content-Type", "text/plain")
+			entry.Response.Headers.Set("ETag", `"v1"`)
+			entry.ETag = `"v1"`
+			reqHeaders := http.Headers{}
+			if test.rangeValue != "" {
+				reqHeaders.Set("Range", test.rangeValue)
+			}
+			if test.ifRange != "" {
+				reqHeaders.Set("If-Range", test.ifRange)
+			}
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+
+			resp := entry.NewRangeResponse(method, reqHeaders)
+			if resp.StatusCode != test.statusCode {
+				t.Fatalf("status code = %d, want %d", resp.StatusCode, test.statusCode)
+			}
+			read, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("read error: %s", err)
+			}
+			contentLength := resp.Headers.Get("Content-Length")
+			if contentLength != strconv.Itoa(len(read)) {
+				t.Errorf("Content-Length = %q, read %d bytes", contentLength, len(read))
+			}
+			if test.parts == nil {
+				contentRange := resp.Headers.Get("Content-Range")
+				if contentRange != test.contentRange || string(read) != test.body {
+					t.Errorf(
+						"Content-Range %q with %q, want %q with %q",
+						contentRange,
+						read,
+						test.contentRange,
+						test.body,
+					)
+				}
+				return
+			}
+
+			contentType := resp.Headers.Get("Content-Type")
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err != nil || mediaType != "multipart/byteranges" {
+				t.Fatalf("Content-Type = %q, want multipart/byteranges", contentType)
+			}
+			reader := multipart.NewReader(strings.NewReader(string(read)), params["boundary"])
+			for i, want := range test.parts {
+				p, err := reader.NextPart()
+				if err != nil {
+					t.Fatalf("part %d error: %s", i, err)
+				}
+				partBody, _ := ioutil.ReadAll(p)
+				if p.Header.Get("Content-Range") != want.contentRange ||
+					p.Header.Get("Content-Type") != "text/plain" ||
+					string(partBody) != want.body {
+					t.Errorf(
+						"part %d = %q %q with %q, want %q with %q",
+						i,
+						p.Header.Get("Content-Type"),
+						p.Header.Get("Content-Range"),
+						partBody,
+						want.contentRange,
+						want.body,
+					)
+				}
+			}
+			if _, err := reader.NextPart(); err == nil {
+				t.Error("multipart body has more parts than ranges")
+			}
+		})
+	}
+}
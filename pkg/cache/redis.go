@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+	"github.com/lexesjan/go-web-proxy-server/pkg/redis"
+)
+
+// redisPrefix is the prefix of every key written to the key-value server.
+const redisPrefix = "goproxy:"
+
+// redisURLsKey is the key of the set of cached URLs.
+const redisURLsKey = redisPrefix + "urls"
+
+// RedisStorage is a Storage which keeps responses in a key-value server which
+// speaks the Redis protocol so that several proxies can share a cache. Each
+// response is stored under its own key encoded the same way as a DiskStorage
+// file. A hash for each URL maps the Vary header and the request header
+// values of each variant to the key of the response. The size of the cache is
+// limited by the server.
+type RedisStorage struct {
+	client *redis.Client
+}
+
+// NewRedisStorage returns a RedisStorage which sends commands with the client
+// specified.
+func NewRedisStorage(client *redis.Client) (storage *RedisStorage) {
+	return &RedisStorage{client: client}
+}
+
+// redisVariantsKey returns the key of the hash which holds the variants of the
+// URL.
+func redisVariantsKey(reqURL string) (key string) {
+	return redisPrefix + "variants:" + reqURL
+}
+
+// redisVariantField returns the hash field which identifies a variant. It
+// holds the names of the request headers which select the variant and their
+// values.
+func redisVariantField(vary []string, varyKey string) (field string) {
+	return strings.Join(vary, ",") + "\n" + varyKey
+}
+
+// parseRedisVariantField returns the names of the request headers which select
+// a variant and their values.
+func parseRedisVariantField(field string) (vary []string, varyKey string) {
+	i := strings.Index(field, "\n")
+	if i < 0 {
+		return []string{}, ""
+	}
+
+	vary = []string{}
+	if i > 0 {
+		vary = strings.Split(field[:i], ",")
+	}
+
+	return vary, field[i+1:]
+}
+
+// replyStrings converts an array reply to strings. Values which are not bulk
+// strings are skipped.
+func replyStrings(reply interface{}) (strs []string) {
+	strs = []string{}
+	values, _ := reply.([]interface{})
+	for _, value := range values {
+		if value, ok := value.([]byte); ok {
+			strs = append(strs, string(value))
+		}
+	}
+
+	return strs
+}
+
+// Get fetches the variant of the URL selected by the request headers from the
+// server. Variants which the server has evicted are forgotten.
+func (storage *RedisStorage) Get(
+	reqURL string,
+	reqHeaders http.Headers,
+) (entry *Entry, ok bool, err error) {
+	reply, err := storage.client.Do("HGETALL", redisVariantsKey(reqURL))
+	if err != nil {
+		return &Entry{}, false, err
+	}
+
+	fields := replyStrings(reply)
+	for i := 0; i+1 < len(fields); i += 2 {
+		vary, key := parseRedisVariantField(fields[i])
+		if varyKey(reqHeaders, vary) != key {
+			continue
+		}
+
+		entryKey := fields[i+1]
+		reply, err = storage.client.Do("GET", entryKey)
+		if err != nil {
+			return &Entry{}, false, err
+		}
+		data, ok := reply.([]byte)
+		if !ok {
+			_, err = storage.client.Do("HDEL", redisVariantsKey(reqURL), fields[i])
+			return &Entry{}, false, err
+		}
+
+		entry, err = decodeEntry(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return &Entry{}, false, err
+		}
+		return entry, true, nil
+	}
+
+	return &Entry{}, false, nil
+}
+
+// Variants fetches every variant of the URL from the server. Variants which
+// the server has evicted are skipped.
+func (storage *RedisStorage) Variants(reqURL string) (entries []*Entry, err error) {
+	reply, err := storage.client.Do("HVALS", redisVariantsKey(reqURL))
+	if err != nil {
+		return []*Entry{}, err
+	}
+
+	entries = []*Entry{}
+	for _, entryKey := range replyStrings(reply) {
+		reply, err := storage.client.Do("GET", entryKey)
+		if err != nil {
+			return []*Entry{}, err
+		}
+		data, ok := reply.([]byte)
+		if !ok {
+			continue
+		}
+		entry, err := decodeEntry(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Put stores the entry on the server. The response is written before it is
+// added to the variants of the URL so that other proxies never find a variant
+// without a response.
+func (storage *RedisStorage) Put(reqURL string, entry *Entry) (err error) {
+	data, err := encodeEntry(reqURL, entry)
+	if err != nil {
+		return err
+	}
+
+	entryKey := redisPrefix + "entry:" + variantID(reqURL, entry.Vary, entry.VaryKey)
+	commands := [][]interface{}{
+		{"SET", entryKey, data},
+		{
+			"HSET",
+			redisVariantsKey(reqURL),
+			redisVariantField(entry.Vary, entry.VaryKey),
+			entryKey,
+		},
+		{"SADD", redisURLsKey, reqURL},
+	}
+	for _, command := range commands {
+		_, err = storage.client.Do(command...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes every variant of the URL from the server.
+func (storage *RedisStorage) Delete(reqURL string) (freed Stats, err error) {
+	variantsKey := redisVariantsKey(reqURL)
+	reply, err := storage.client.Do("HVALS", variantsKey)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	args := []interface{}{"DEL", variantsKey}
+	for _, entryKey := range replyStrings(reply) {
+		reply, err := storage.client.Do("STRLEN", entryKey)
+		if err != nil {
+			return Stats{}, err
+		}
+		if size, _ := reply.(int64); size > 0 {
+			freed.Entries++
+			freed.Size += size
+		}
+		args = append(args, entryKey)
+	}
+	_, err = storage.client.Do(args...)
+	if err != nil {
+		return Stats{}, err
+	}
+	_, err = storage.client.Do("SREM", redisURLsKey, reqURL)
+
+	return freed, err
+}
+
+// DeleteVariant removes the variant of the URL with the variant ID from the
+// server. The URL is removed from the set of cached URLs once it has no
+// variants left.
+func (storage *RedisStorage) DeleteVariant(
+	reqURL string,
+	id string,
+) (freed Stats, err error) {
+	variantsKey := redisVariantsKey(reqURL)
+	reply, err := storage.client.Do("HGETALL", variantsKey)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	fields := replyStrings(reply)
+	for i := 0; i+1 < len(fields); i += 2 {
+		vary, key := parseRedisVariantField(fields[i])
+		if variantID(reqURL, vary, key) != id {
+			continue
+		}
+
+		entryKey := fields[i+1]
+		reply, err := storage.client.Do("STRLEN", entryKey)
+		if err != nil {
+			return Stats{}, err
+		}
+		if size, _ := reply.(int64); size > 0 {
+			freed = Stats{Entries: 1, Size: size}
+		}
+		commands := [][]interface{}{
+			{"HDEL", variantsKey, fields[i]},
+			{"DEL", entryKey},
+		}
+		for _, command := range commands {
+			_, err = storage.client.Do(command...)
+			if err != nil {
+				return Stats{}, err
+			}
+		}
+		break
+	}
+
+	reply, err = storage.client.Do("HLEN", variantsKey)
+	if err != nil {
+		return freed, err
+	}
+	if numVariants, _ := reply.(int64); numVariants == 0 {
+		_, err = storage.client.Do("SREM", redisURLsKey, reqURL)
+	}
+
+	return freed, err
+}
+
+// Range calls f with each URL on the server and the number of variants stored
+// for it.
+func (storage *RedisStorage) Range(
+	f func(reqURL string, numVariants int) bool,
+) (err error) {
+	reply, err := storage.client.Do("SMEMBERS", redisURLsKey)
+	if err != nil {
+		return err
+	}
+
+	for _, reqURL := range replyStrings(reply) {
+		reply, err := storage.client.Do("HLEN", redisVariantsKey(reqURL))
+		if err != nil {
+			return err
+		}
+		numVariants, _ := reply.(int64)
+		if numVariants == 0 {
+			continue
+		}
+		if !f(reqURL, int(numVariants)) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the number and size of the responses on the server.
+func (storage *RedisStorage) Stats() (stats Stats, err error) {
+	reply, err := storage.client.Do("SMEMBERS", redisURLsKey)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	for _, reqURL := range replyStrings(reply) {
+		reply, err := storage.client.Do("HVALS", redisVariantsKey(reqURL))
+		if err != nil {
+			return Stats{}, err
+		}
+		for _, entryKey := range replyStrings(reply) {
+			reply, err := storage.client.Do("STRLEN", entryKey)
+			if err != nil {
+				return Stats{}, err
+			}
+			if size, _ := reply.(int64); size > 0 {
+				stats.Entries++
+				stats.Size += size
+			}
+		}
+	}
+
+	return stats, nil
+}
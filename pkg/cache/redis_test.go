@@ -0,0 +1,433 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+	"github.com/lexesjan/go-web-proxy-server/pkg/redis"
+)
+
+// fakeRedis is an in-process key-value server which speaks enough of the Redis
+// protocol for RedisStorage.
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	strings  map[string][]byte
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+}
+
+// newFakeRedis starts a fakeRedis on a local port which is closed when the test
+// ends.
+func newFakeRedis(t *testing.T) (server *fakeRedis) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = &fakeRedis{
+		listener: listener,
+		strings:  make(map[string][]byte),
+		hashes:   make(map[string]map[string]string),
+		sets:     make(map[string]map[string]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+
+	return server
+}
+
+func (server *fakeRedis) addr() string {
+	return server.listener.Addr().String()
+}
+
+// evict removes a key as the server would when it runs out of memory.
+func (server *fakeRedis) evict(key string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	delete(server.strings, key)
+}
+
+func (server *fakeRedis) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.do(writer, args)
+		server.mu.Unlock()
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// readFakeCommand reads a command sent as an array of bulk strings.
+func readFakeCommand(reader *bufio.Reader) (args []string, err error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return []string{}, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return []string{}, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return []string{}, err
+	}
+
+	args = make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return []string{}, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return []string{}, err
+		}
+		value := make([]byte, length+2)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return []string{}, err
+		}
+		args[i] = string(value[:length])
+	}
+
+	return args, nil
+}
+
+// do runs the command and writes its reply. The server lock must be held.
+func (server *fakeRedis) do(writer *bufio.Writer, args []string) {
+	bulk := func(value string) {
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(value), value)
+	}
+	array := func(values []string) {
+		fmt.Fprintf(writer, "*%d\r\n", len(values))
+		for _, value := range values {
+			bulk(value)
+		}
+	}
+	integer := func(n int) {
+		fmt.Fprintf(writer, ":%d\r\n", n)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		server.strings[args[1]] = []byte(args[2])
+		writer.WriteString("+OK\r\n")
+	case "GET":
+		value, ok := server.strings[args[1]]
+		if !ok {
+			writer.WriteString("$-1\r\n")
+			return
+		}
+		bulk(string(value))
+	case "STRLEN":
+		integer(len(server.strings[args[1]]))
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := server.strings[key]; ok {
+				delete(server.strings, key)
+				n++
+			}
+			if _, ok := server.hashes[key]; ok {
+				delete(server.hashes, key)
+				n++
+			}
+		}
+		integer(n)
+	case "HSET":
+		hash, ok := server.hashes[args[1]]
+		if !ok {
+			hash = make(map[string]string)
+			server.hashes[args[1]] = hash
+		}
+		_, existed := hash[args[2]]
+		hash[args[2]] = args[3]
+		if existed {
+			integer(0)
+		} else {
+			integer(1)
+		}
+	case "HDEL":
+		hash := server.hashes[args[1]]
+		_, ok := hash[args[2]]
+		delete(hash, args[2])
+		if len(hash) == 0 {
+			delete(server.hashes, args[1])
+		}
+		if ok {
+			integer(1)
+		} else {
+			integer(0)
+		}
+	case "HGETALL":
+		values := []string{}
+		for field, value := range server.hashes[args[1]] {
+			values = append(values, field, value)
+		}
+		array(values)
+	case "HVALS":
+		values := []string{}
+		for _, value := range server.hashes[args[1]] {
+			values = append(values, value)
+		}
+		array(values)
+	case "HLEN":
+		integer(len(server.hashes[args[1]]))
+	case "SADD":
+		set, ok := server.sets[args[1]]
+		if !ok {
+			set = make(map[string]bool)
+			server.sets[args[1]] = set
+		}
+		set[args[2]] = true
+		integer(1)
+	case "SREM":
+		delete(server.sets[args[1]], args[2])
+		integer(1)
+	case "SMEMBERS":
+		members := []string{}
+		for member := range server.sets[args[1]] {
+			members = append(members, member)
+		}
+		array(members)
+	default:
+		fmt.Fprintf(writer, "-ERR unknown command %q\r\n", args[0])
+	}
+}
+
+// newTestEntry returns an entry with the body selected by the request headers
+// named in vary.
+func newTestEntry(body string, vary []string, reqHeaders http.Headers) (entry *Entry) {
+	headers := http.Headers{
+		{Name: "Date", Value: testDate(0)},
+		{Name: "Cache-Control", Value: "max-age=60"},
+		{Name: "Content-Length", Value: strconv.Itoa(len(body))},
+	}
+	if len(vary) > 0 {
+		headers.Add("Vary", strings.Join(vary, ", "))
+	}
+
+	return &Entry{
+		Response: &http.Response{
+			StatusCode:        200,
+			StatusDescription: "OK",
+			Headers:           headers,
+			HTTPVer:           "HTTP/1.1",
+		},
+		Body:         []byte(body),
+		Vary:         vary,
+		VaryKey:      varyKey(reqHeaders, vary),
+		RequestTime:  testTime,
+		ResponseTime: testTime,
+	}
+}
+
+// encodedSize returns the number of bytes the entry takes on the server.
+func encodedSize(t *testing.T, reqURL string, entry *Entry) int64 {
+	data, err := encodeEntry(reqURL, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int64(len(data))
+}
+
+func TestRedisStorage(t *testing.T) {
+	server := newFakeRedis(t)
+	storage := NewRedisStorage(redis.NewClient(server.addr(), time.Second))
+
+	const reqURL = "http://www.example.com/index.html"
+	const otherURL = "http://www.example.com/other.html"
+	vary := []string{"Accept-Encoding"}
+	gzipHeaders := http.Headers{{Name: "Accept-Encoding", Value: "gzip"}}
+	plainHeaders := http.Headers{}
+	gzipEntry := newTestEntry("gzipped", vary, gzipHeaders)
+	plainEntry := newTestEntry("plain", vary, plainHeaders)
+	otherEntry := newTestEntry("other", []string{}, plainHeaders)
+	for _, put := range []struct {
+		reqURL string
+		entry  *Entry
+	}{
+		{reqURL, gzipEntry},
+		{reqURL, plainEntry},
+		{otherURL, otherEntry},
+	} {
+		if err := storage.Put(put.reqURL, put.entry); err != nil {
+			t.Fatalf("Put(%q) error: %s", put.reqURL, err)
+		}
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			reqURL     string
+			reqHeaders http.Headers
+			body       string
+			ok         bool
+		}{
+			{"variant", reqURL, gzipHeaders, "gzipped", true},
+			{"other variant", reqURL, plainHeaders, "plain", true},
+			{
+				"normalised request header",
+				reqURL,
+				http.Headers{{Name: "accept-encoding", Value: " GZIP "}},
+				"gzipped",
+				true,
+			},
+			{
+				"no matching variant",
+				reqURL,
+				http.Headers{{Name: "Accept-Encoding", Value: "br"}},
+				"",
+				false,
+			},
+			{"no variants", "http://www.example.com/missing", plainHeaders, "", false},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				entry, ok, err := storage.Get(test.reqURL, test.reqHeaders)
+				if err != nil {
+					t.Fatalf("Get() error: %s", err)
+				}
+				if ok != test.ok || string(entry.Body) != test.body {
+					t.Errorf(
+						"Get() = %q, %t, want %q, %t",
+						entry.Body,
+						ok,
+						test.body,
+						test.ok,
+					)
+				}
+				if ok && entry.reqURL != test.reqURL {
+					t.Errorf("Get() URL = %q, want %q", entry.reqURL, test.reqURL)
+				}
+			})
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		numVariants := map[string]int{}
+		err := storage.Range(func(reqURL string, n int) bool {
+			numVariants[reqURL] = n
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Range() error: %s", err)
+		}
+		if len(numVariants) != 2 || numVariants[reqURL] != 2 ||
+			numVariants[otherURL] != 1 {
+			t.Errorf("Range() = %v, want 2 variants of %q and 1 of %q", numVariants, reqURL, otherURL)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := storage.Stats()
+		if err != nil {
+			t.Fatalf("Stats() error: %s", err)
+		}
+		want := Stats{
+			Entries: 3,
+			Size: encodedSize(t, reqURL, gzipEntry) +
+				encodedSize(t, reqURL, plainEntry) +
+				encodedSize(t, otherURL, otherEntry),
+		}
+		if stats != want {
+			t.Errorf("Stats() = %+v, want %+v", stats, want)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		freed, err := storage.Delete(reqURL)
+		if err != nil {
+			t.Fatalf("Delete() error: %s", err)
+		}
+		want := Stats{
+			Entries: 2,
+			Size:    encodedSize(t, reqURL, gzipEntry) + encodedSize(t, reqURL, plainEntry),
+		}
+		if freed != want {
+			t.Errorf("Delete() = %+v, want %+v", freed, want)
+		}
+		if _, ok, _ := storage.Get(reqURL, gzipHeaders); ok {
+			t.Errorf("Get() found a deleted variant")
+		}
+
+		stats, err := storage.Stats()
+		if err != nil {
+			t.Fatalf("Stats() error: %s", err)
+		}
+		want = Stats{Entries: 1, Size: encodedSize(t, otherURL, otherEntry)}
+		if stats != want {
+			t.Errorf("Stats() after Delete() = %+v, want %+v", stats, want)
+		}
+	})
+}
+
+func TestRedisStorageEvicted(t *testing.T) {
+	server := newFakeRedis(t)
+	storage := NewRedisStorage(redis.NewClient(server.addr(), time.Second))
+
+	const reqURL = "http://www.example.com/index.html"
+	entry := newTestEntry("evicted", []string{}, http.Headers{})
+	if err := storage.Put(reqURL, entry); err != nil {
+		t.Fatalf("Put() error: %s", err)
+	}
+	server.evict(redisPrefix + "entry:" + variantID(reqURL, entry.Vary, entry.VaryKey))
+
+	stats, err := storage.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error: %s", err)
+	}
+	if stats != (Stats{}) {
+		t.Errorf("Stats() = %+v, want no entries", stats)
+	}
+	entries, err := storage.Variants(reqURL)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Variants() = %d entries, %v, want none", len(entries), err)
+	}
+	_, ok, err := storage.Get(reqURL, http.Headers{})
+	if err != nil || ok {
+		t.Errorf("Get() = %t, %v, want not found", ok, err)
+	}
+
+	// The variant is forgotten once Get finds it was evicted.
+	err = storage.Range(func(rangeURL string, n int) bool {
+		t.Errorf("Range() called with %q, %d variants, want no URLs", rangeURL, n)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Range() error: %s", err)
+	}
+	freed, err := storage.Delete(reqURL)
+	if err != nil || freed != (Stats{}) {
+		t.Errorf("Delete() = %+v, %v, want nothing freed", freed, err)
+	}
+}
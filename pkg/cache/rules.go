@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// Rule overrides how the responses of the URLs matching its pattern are
+// cached. The pattern is a host optionally followed by a path prefix e.g.
+// www.example.com/static/. A host starting with *. matches every subdomain of
+// the host and a host without a port matches the host on any port.
+//
+// TTL replaces the freshness lifetime of the response if it is not 0.
+// IgnoreNoStore stores responses with the no-store or private directives. Skip
+// stops the responses from being cached at all. MaxSize lowers the maximum
+// size of a cached response body if it is not 0.
+type Rule struct {
+	Pattern       string
+	TTL           time.Duration
+	IgnoreNoStore bool
+	Skip          bool
+	MaxSize       int64
+	host          string
+	path          string
+}
+
+// ParseRule parses a rule written as a pattern followed by its options
+// separated by spaces e.g. "www.example.com/static/ ttl=24h ignore-no-store".
+// The options are ttl=<duration>, ignore-no-store, skip and max-size=<bytes>.
+func ParseRule(line string) (rule *Rule, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return &Rule{}, fmt.Errorf("rule %q needs a pattern and an option", line)
+	}
+
+	rule = &Rule{Pattern: fields[0]}
+	if strings.Contains(rule.Pattern, "://") {
+		return &Rule{}, fmt.Errorf("pattern %q must not have a scheme", rule.Pattern)
+	}
+	rule.host = strings.ToLower(rule.Pattern)
+	if slash := strings.IndexByte(rule.host, '/'); slash >= 0 {
+		rule.host, rule.path = rule.host[:slash], rule.Pattern[slash:]
+	}
+	if rule.host == "" || rule.host == "*." {
+		return &Rule{}, fmt.Errorf("pattern %q has no host", rule.Pattern)
+	}
+
+	for _, option := range fields[1:] {
+		name, value := option, ""
+		if equals := strings.IndexByte(option, '='); equals >= 0 {
+			name, value = option[:equals], option[equals+1:]
+		}
+		switch {
+		case name == "ttl" && value != "":
+			rule.TTL, err = time.ParseDuration(value)
+			if err != nil || rule.TTL <= 0 {
+				return &Rule{}, fmt.Errorf("invalid ttl %q", value)
+			}
+		case name == "max-size" && value != "":
+			rule.MaxSize, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || rule.MaxSize <= 0 {
+				return &Rule{}, fmt.Errorf("invalid max-size %q", value)
+			}
+		case option == "ignore-no-store":
+			rule.IgnoreNoStore = true
+		case option == "skip":
+			rule.Skip = true
+		default:
+			return &Rule{}, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	if rule.Skip && (rule.TTL != 0 || rule.IgnoreNoStore || rule.MaxSize != 0) {
+		return &Rule{}, fmt.Errorf("skip can't be combined with other options")
+	}
+
+	return rule, nil
+}
+
+// ReadRules reads one rule per line in the format of ParseRule. Blank lines
+// and lines starting with # are ignored. The line number is added to any
+// error.
+func ReadRules(reader io.Reader) (rules []*Rule, err error) {
+	rules = []*Rule{}
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := ParseRule(line)
+		if err != nil {
+			return []*Rule{}, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return []*Rule{}, err
+	}
+
+	return rules, nil
+}
+
+func (rule *Rule) String() string {
+	options := []string{rule.Pattern}
+	if rule.TTL != 0 {
+		options = append(options, "ttl="+rule.TTL.String())
+	}
+	if rule.IgnoreNoStore {
+		options = append(options, "ignore-no-store")
+	}
+	if rule.Skip {
+		options = append(options, "skip")
+	}
+	if rule.MaxSize != 0 {
+		options = append(options, "max-size="+strconv.FormatInt(rule.MaxSize, 10))
+	}
+
+	return strings.Join(options, " ")
+}
+
+// matches reports whether the rule applies to the URL.
+func (rule *Rule) matches(parsedURL *url.URL) bool {
+	host := strings.ToLower(parsedURL.Host)
+	hostname := strings.ToLower(parsedURL.Hostname())
+	if strings.HasPrefix(rule.host, "*.") {
+		if !strings.HasSuffix(host, rule.host[1:]) &&
+			!strings.HasSuffix(hostname, rule.host[1:]) {
+			return false
+		}
+	} else if rule.host != host && rule.host != hostname {
+		return false
+	}
+
+	return strings.HasPrefix(parsedURL.Path, rule.path)
+}
+
+// moreSpecific reports whether the rule takes priority over the other rule
+// when both match a URL. Longer paths take priority followed by hosts without
+// a wildcard.
+func (rule *Rule) moreSpecific(other *Rule) bool {
+	if len(rule.path) != len(other.path) {
+		return len(rule.path) > len(other.path)
+	}
+	wildcard := strings.HasPrefix(rule.host, "*.")
+	otherWildcard := strings.HasPrefix(other.host, "*.")
+	if wildcard != otherWildcard {
+		return !wildcard
+	}
+
+	return len(rule.host) > len(other.host)
+}
+
+// AddRule adds the rule replacing any rule with the same pattern. The replaced
+// result reports whether a rule was replaced.
+func (cache *Cache) AddRule(rule *Rule) (replaced bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	_, replaced = cache.rules[rule.Pattern]
+	cache.rules[rule.Pattern] = rule
+
+	return replaced
+}
+
+// RemoveRule removes the rule with the pattern. The ok result reports whether
+// the rule existed.
+func (cache *Cache) RemoveRule(pattern string) (ok bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	_, ok = cache.rules[pattern]
+	delete(cache.rules, pattern)
+
+	return ok
+}
+
+// Rules returns the rules sorted by pattern.
+func (cache *Cache) Rules() (rules []*Rule) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	rules = make([]*Rule, 0, len(cache.rules))
+	for _, rule := range cache.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Pattern < rules[j].Pattern
+	})
+
+	return rules
+}
+
+// rule returns the most specific rule which applies to the URL. The ok result
+// reports whether any rule applies.
+func (cache *Cache) rule(reqURL string) (rule *Rule, ok bool) {
+	parsedURL, err := url.Parse(reqURL)
+	if err != nil {
+		return &Rule{}, false
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	rule = &Rule{}
+	for _, candidate := range cache.rules {
+		if candidate.matches(parsedURL) && (!ok || candidate.moreSpecific(rule)) {
+			rule, ok = candidate, true
+		}
+	}
+
+	return rule, ok
+}
+
+// cacheable reports whether the response to a request for the URL may be
+// stored like Cacheable once the rule for the URL is applied.
+func (cache *Cache) cacheable(
+	reqURL string,
+	method string,
+	reqHeaders http.Headers,
+	resp *http.Response,
+) (ok bool, reason string) {
+	rule, found := cache.rule(reqURL)
+	if found && rule.Skip {
+		return false, fmt.Sprintf("the rule %q skips caching", rule.Pattern)
+	}
+	if found && rule.IgnoreNoStore {
+		resp = &http.Response{
+			StatusCode: resp.StatusCode,
+			Headers:    withoutDirectives(resp.Headers, "no-store", "private"),
+		}
+	}
+
+	return Cacheable(method, reqHeaders, resp)
+}
+
+// withoutDirectives returns a copy of the headers without the Cache-Control
+// directives named.
+func withoutDirectives(headers http.Headers, names ...string) (kept http.Headers) {
+	kept = http.Headers{}
+	directives := []string{}
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, "Cache-Control") {
+			continue
+		}
+		kept = append(kept, header)
+	}
+	for _, directive := range headers.CacheControl() {
+		name := directive
+		if equals := strings.IndexByte(directive, '='); equals >= 0 {
+			name = strings.TrimSpace(directive[:equals])
+		}
+		if !contains(names, name) {
+			directives = append(directives, directive)
+		}
+	}
+	if len(directives) > 0 {
+		kept.Add("Cache-Control", strings.Join(directives, ", "))
+	}
+
+	return kept
+}
@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		rule Rule
+	}{
+		{
+			line: "www.example.com/static/ ttl=24h ignore-no-store",
+			ok:   true,
+			rule: Rule{
+				Pattern:       "www.example.com/static/",
+				TTL:           24 * time.Hour,
+				IgnoreNoStore: true,
+				host:          "www.example.com",
+				path:          "/static/",
+			},
+		},
+		{
+			line: "  *.Example.com   max-size=1024  ",
+			ok:   true,
+			rule: Rule{Pattern: "*.Example.com", MaxSize: 1024, host: "*.example.com"},
+		},
+		{
+			line: "WWW.example.com:8080/Docs skip",
+			ok:   true,
+			rule: Rule{
+				Pattern: "WWW.example.com:8080/Docs",
+				Skip:    true,
+				host:    "www.example.com:8080",
+				path:    "/Docs",
+			},
+		},
+		{line: "www.example.com"},
+		{line: ""},
+		{line: "http://www.example.com/ skip"},
+		{line: "/static/ skip"},
+		{line: "*. skip"},
+		{line: "*./static/ skip"},
+		{line: "www.example.com ttl"},
+		{line: "www.example.com ttl="},
+		{line: "www.example.com ttl=0s"},
+		{line: "www.example.com ttl=-1h"},
+		{line: "www.example.com ttl=forever"},
+		{line: "www.example.com max-size=0"},
+		{line: "www.example.com max-size=1KB"},
+		{line: "www.example.com ignore-no-store=true"},
+		{line: "www.example.com skip=1"},
+		{line: "www.example.com no-store"},
+		{line: "www.example.com skip ttl=1h"},
+		{line: "www.example.com ignore-no-store skip"},
+		{line: "www.example.com skip max-size=10"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			rule, err := ParseRule(test.line)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("ParseRule() = %+v, want an error", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRule() error: %s", err)
+			}
+			if !reflect.DeepEqual(*rule, test.rule) {
+				t.Errorf("ParseRule() = %+v, want %+v", *rule, test.rule)
+			}
+			// A rule is listed in the same format it is parsed from.
+			reparsed, err := ParseRule(rule.String())
+			if err != nil || !reflect.DeepEqual(reparsed, rule) {
+				t.Errorf("ParseRule(%q) = %+v, %v, want %+v", rule.String(), reparsed, err, rule)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		matches bool
+	}{
+		{"www.example.com", "http://www.example.com/", true},
+		{"www.example.com", "http://WWW.Example.com/page", true},
+		{"www.example.com", "http://www.example.com:8080/", true},
+		{"www.example.com", "http://example.com/", false},
+		{"www.example.com", "http://www.example.com.evil.com/", false},
+		{"www.example.com:8080", "http://www.example.com:8080/", true},
+		{"www.example.com:8080", "http://www.example.com/", false},
+		{"www.example.com:8080", "http://www.example.com:8081/", false},
+		{"*.example.com", "http://www.example.com/", true},
+		{"*.example.com", "http://a.b.example.com:8080/", true},
+		{"*.example.com", "http://example.com/", false},
+		{"*.example.com", "http://badexample.com/", false},
+		{"*.example.com:8080", "http://www.example.com:8080/", true},
+		{"*.example.com:8080", "http://www.example.com/", false},
+		{"www.example.com/static/", "http://www.example.com/static/app.js", true},
+		{"www.example.com/static/", "http://www.example.com/static/", true},
+		{"www.example.com/static/", "http://www.example.com/static", false},
+		{"www.example.com/static/", "http://www.example.com/Static/app.js", false},
+		{"www.example.com/static/", "http://www.example.com/app.js?/static/", false},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRule(test.pattern + " skip")
+		if err != nil {
+			t.Fatalf("ParseRule(%q) error: %s", test.pattern, err)
+		}
+		parsedURL, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := rule.matches(parsedURL); matches != test.matches {
+			t.Errorf("%q matches %q = %t, want %t", test.pattern, test.url, matches, test.matches)
+		}
+	}
+}
+
+func TestRuleMoreSpecific(t *testing.T) {
+	tests := []struct {
+		pattern string
+		other   string
+		more    bool
+	}{
+		{"www.example.com/static/", "www.example.com", true},
+		{"www.example.com/static/js/", "www.example.com/static/", true},
+		{"*.example.com/static/", "www.example.com", true},
+		{"www.example.com", "*.example.com", true},
+		{"www.example.com/static/", "*.example.com/static/", true},
+		{"*.www.example.com", "*.example.com", true},
+		{"www.example.com:8080", "www.example.com", true},
+		{"www.example.com", "www.example.com", false},
+	}
+
+	for _, test := range tests {
+		rule, _ := ParseRule(test.pattern + " skip")
+		other, _ := ParseRule(test.other + " skip")
+		if more := rule.moreSpecific(other); more != test.more {
+			t.Errorf("%q more specific than %q = %t, want %t", test.pattern, test.other, more, test.more)
+		}
+		if test.more && other.moreSpecific(rule) {
+			t.Errorf("%q more specific than %q", test.other, test.pattern)
+		}
+	}
+}
+
+// TestCacheRule checks that the most specific rule matching a URL is applied
+// whatever order the rules were added in.
+func TestCacheRule(t *testing.T) {
+	cache := NewCache(NewMemoryStorage(0, nil), 1024)
+	for _, line := range []string{
+		"*.example.com ttl=1h",
+		"www.example.com/static/ ttl=24h",
+		"www.example.com max-size=10",
+		"www.example.com/static/private/ skip",
+	} {
+		rule, err := ParseRule(line)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) error: %s", line, err)
+		}
+		cache.AddRule(rule)
+	}
+
+	tests := []struct {
+		url     string
+		pattern string
+	}{
+		{"http://cdn.example.com/static/app.js", "*.example.com"},
+		{"http://www.example.com/", "www.example.com"},
+		{"http://www.example.com/static/app.js", "www.example.com/static/"},
+		{"http://www.example.com/static/private/key", "www.example.com/static/private/"},
+		{"http://www.example.org/", ""},
+	}
+	for _, test := range tests {
+		rule, ok := cache.rule(test.url)
+		if ok != (test.pattern != "") || rule.Pattern != test.pattern {
+			t.Errorf("rule(%q) = %q, %t, want %q", test.url, rule.Pattern, ok, test.pattern)
+		}
+	}
+}
+
+func TestWithoutDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Headers
+		want    http.Headers
+	}{
+		{
+			name: "named directives removed",
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "no-store, max-age=60, private"},
+				{Name: "Content-Type", Value: "text/html"},
+			},
+			want: http.Headers{
+				{Name: "Content-Type", Value: "text/html"},
+				{Name: "Cache-Control", Value: "max-age=60"},
+			},
+		},
+		{
+			name: "names matched case-insensitively with values",
+			headers: http.Headers{
+				{Name: "cache-control", Value: `Private="Set-Cookie"`},
+				{Name: "Cache-Control", Value: "NO-STORE, public"},
+			},
+			want: http.Headers{{Name: "Cache-Control", Value: "public"}},
+		},
+		{
+			name: "header dropped once empty",
+			headers: http.Headers{
+				{Name: "Cache-Control", Value: "no-store"},
+				{Name: "Content-Type", Value: "text/html"},
+			},
+			want: http.Headers{{Name: "Content-Type", Value: "text/html"}},
+		},
+		{
+			name:    "similar names kept",
+			headers: http.Headers{{Name: "Cache-Control", Value: "no-store-ish, privately"}},
+			want:    http.Headers{{Name: "Cache-Control", Value: "no-store-ish, privately"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := test.headers.Clone()
+			kept := withoutDirectives(test.headers, "no-store", "private")
+			if !reflect.DeepEqual(kept, test.want) {
+				t.Errorf("withoutDirectives() = %q, want %q", kept, test.want)
+			}
+			if !reflect.DeepEqual(test.headers, original) {
+				t.Errorf("withoutDirectives() changed the headers to %q", test.headers)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiry is the time a variant of a URL becomes stale.
+type expiry struct {
+	at     time.Time
+	reqURL string
+	id     string
+	index  int
+}
+
+// expiryHeap orders expiries with the earliest first.
+type expiryHeap []*expiry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	expiry := x.(*expiry)
+	expiry.index = len(*h)
+	*h = append(*h, expiry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	expiry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return expiry
+}
+
+// scheduler calls a function when cached variants become stale. A single
+// goroutine waits for the earliest expiry so the number of timers does not
+// grow with the number of cached responses. Only the URL and variant ID are
+// kept so variants removed from the cache are not kept in memory. Variants
+// must be unscheduled when they are removed.
+type scheduler struct {
+	mu   sync.Mutex
+	heap expiryHeap
+	ids  map[string]*expiry
+	// urls holds the expiries of the variants of each URL.
+	urls     map[string]map[string]*expiry
+	wake     chan struct{}
+	onExpire func(reqURL string, id string)
+}
+
+// newScheduler returns a new scheduler which calls onExpire with the URL and
+// variant ID of each variant which becomes stale.
+func newScheduler(onExpire func(reqURL string, id string)) (s *scheduler) {
+	s = &scheduler{
+		heap:     expiryHeap{},
+		ids:      make(map[string]*expiry),
+		urls:     make(map[string]map[string]*expiry),
+		wake:     make(chan struct{}, 1),
+		onExpire: onExpire,
+	}
+	go s.run()
+
+	return s
+}
+
+// schedule sets the time the variant of the URL becomes stale replacing the
+// time previously set for the variant.
+func (s *scheduler) schedule(reqURL string, entry *Entry, at time.Time) {
+	id := variantID(reqURL, entry.Vary, entry.VaryKey)
+
+	s.mu.Lock()
+	if scheduled, ok := s.ids[id]; ok {
+		scheduled.at = at
+		heap.Fix(&s.heap, scheduled.index)
+	} else {
+		scheduled = &expiry{at: at, reqURL: reqURL, id: id}
+		heap.Push(&s.heap, scheduled)
+		s.ids[id] = scheduled
+		if _, ok := s.urls[reqURL]; !ok {
+			s.urls[reqURL] = make(map[string]*expiry)
+		}
+		s.urls[reqURL][id] = scheduled
+	}
+	earliest := s.heap[0].id == id
+	s.mu.Unlock()
+
+	// The goroutine may be waiting for a later expiry.
+	if earliest {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule forgets the time the variant of the URL becomes stale.
+func (s *scheduler) unschedule(reqURL string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if scheduled, ok := s.ids[id]; ok {
+		heap.Remove(&s.heap, scheduled.index)
+		s.removeLocked(scheduled)
+	}
+}
+
+// unscheduleURL forgets the times every variant of the URL becomes stale.
+func (s *scheduler) unscheduleURL(reqURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, scheduled := range s.urls[reqURL] {
+		heap.Remove(&s.heap, scheduled.index)
+		s.removeLocked(scheduled)
+	}
+}
+
+// removeLocked removes an expiry which is no longer in the heap from the
+// indexes. The scheduler lock must be held.
+func (s *scheduler) removeLocked(scheduled *expiry) {
+	delete(s.ids, scheduled.id)
+	delete(s.urls[scheduled.reqURL], scheduled.id)
+	if len(s.urls[scheduled.reqURL]) == 0 {
+		delete(s.urls, scheduled.reqURL)
+	}
+}
+
+// run waits for each expiry in turn.
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		now := time.Now()
+		expired := []*expiry{}
+		wait := time.Hour
+
+		s.mu.Lock()
+		for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+			expiry := heap.Pop(&s.heap).(*expiry)
+			s.removeLocked(expiry)
+			expired = append(expired, expiry)
+		}
+		if len(s.heap) > 0 {
+			wait = s.heap[0].at.Sub(now)
+		}
+		s.mu.Unlock()
+
+		for _, expiry := range expired {
+			s.onExpire(expiry.reqURL, expiry.id)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// Storage stores the cached responses of a Cache. Each URL may have several
+// variants which are selected by the request headers named in their Vary
+// header. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the variant of the URL selected by the request headers. The
+	// ok result indicates whether a variant was found.
+	Get(reqURL string, reqHeaders http.Headers) (entry *Entry, ok bool, err error)
+	// Variants returns every variant of the URL without changing how recently
+	// they were used.
+	Variants(reqURL string) (entries []*Entry, err error)
+	// Put stores the entry as a variant of the URL replacing the variant
+	// selected by the same request headers.
+	Put(reqURL string, entry *Entry) (err error)
+	// Delete removes every variant of the URL and returns the number and size
+	// of the responses removed.
+	Delete(reqURL string) (freed Stats, err error)
+	// DeleteVariant removes the variant of the URL with the variant ID and
+	// returns the number and size of the responses removed.
+	DeleteVariant(reqURL string, id string) (freed Stats, err error)
+	// Range calls f with each URL and the number of variants stored for it
+	// until f returns false.
+	Range(f func(reqURL string, numVariants int) bool) (err error)
+	// Stats returns the number and size of the stored responses.
+	Stats() (stats Stats, err error)
+}
+
+// Stats represent the responses held by a Storage.
+type Stats struct {
+	Entries int
+	Size    int64
+}
+
+// evictingStorage is implemented by Storages which evict responses on their own
+// to stay within a size limit. The function set is called with the URL and
+// variant ID of each response evicted so that the Cache can forget it.
+type evictingStorage interface {
+	setEvicted(evicted func(reqURL string, id string))
+}
+
+// entryMetadata is the information stored with an encoded response which can't
+// be recovered from the response itself.
+type entryMetadata struct {
+	URL                  string
+	Vary                 []string
+	VaryKey              string
+	Lifetime             time.Duration `json:",omitempty"`
+	RequestTime          time.Time
+	ResponseTime         time.Time
+	UncachedResponseTime time.Duration
+	UncachedBandwidth    int64
+	// Size is the length of the encoded response which follows the metadata
+	// so that a stored response can be checked without reading it.
+	Size int64 `json:",omitempty"`
+}
+
+// encodeEntry returns the entry encoded as a line of JSON holding the metadata
+// followed by the response exactly as it is served.
+func encodeEntry(reqURL string, entry *Entry) (data []byte, err error) {
+	head := entry.Response.String()
+	metadata, err := json.Marshal(&entryMetadata{
+		URL:                  reqURL,
+		Vary:                 entry.Vary,
+		VaryKey:              entry.VaryKey,
+		Lifetime:             entry.Lifetime,
+		RequestTime:          entry.RequestTime,
+		ResponseTime:         entry.ResponseTime,
+		UncachedResponseTime: entry.UncachedResponseTime,
+		UncachedBandwidth:    entry.UncachedBandwidth,
+		Size:                 int64(len(head) + len(entry.Body)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var builder strings.Builder
+	builder.Write(metadata)
+	builder.WriteString("\n")
+	builder.WriteString(head)
+	builder.Write(entry.Body)
+
+	return []byte(builder.String()), nil
+}
+
+// decodeMetadata reads the metadata line of an entry encoded by encodeEntry and
+// returns it along with the length of the line.
+func decodeMetadata(reader *bufio.Reader) (
+	metadata *entryMetadata,
+	length int64,
+	err error,
+) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return &entryMetadata{}, 0, err
+	}
+	metadata = &entryMetadata{}
+	err = json.Unmarshal(line, metadata)
+	if err != nil {
+		return &entryMetadata{}, 0, err
+	}
+
+	return metadata, int64(len(line)), nil
+}
+
+// decodeEntry reads an entry encoded by encodeEntry. An error is returned if
+// the encoded entry is not complete.
+func decodeEntry(reader *bufio.Reader) (entry *Entry, err error) {
+	metadata, _, err := decodeMetadata(reader)
+	if err != nil {
+		return &Entry{}, err
+	}
+
+	resp, err := http.NewResponse(reader, "GET")
+	if err != nil {
+		return &Entry{}, err
+	}
+	// Responses such as 204 No Content are stored without a Content-Length.
+	body := []byte{}
+	if resp.HasBody() {
+		contentLength, err := strconv.ParseInt(resp.Headers.Get("Content-Length"), 10, 0)
+		if err != nil {
+			return &Entry{}, err
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return &Entry{}, err
+		}
+		if int64(len(body)) != contentLength {
+			return &Entry{}, fmt.Errorf("cached response for %q is truncated", metadata.URL)
+		}
+	}
+	resp.Body = nil
+
+	entry = &Entry{
+		reqURL:               metadata.URL,
+		Response:             resp,
+		Body:                 body,
+		Vary:                 metadata.Vary,
+		VaryKey:              metadata.VaryKey,
+		Lifetime:             metadata.Lifetime,
+		ETag:                 resp.Headers.Get("ETag"),
+		LastModified:         resp.Headers.Get("Last-Modified"),
+		RequestTime:          metadata.RequestTime,
+		ResponseTime:         metadata.ResponseTime,
+		UncachedResponseTime: metadata.UncachedResponseTime,
+		UncachedBandwidth:    metadata.UncachedBandwidth,
+	}
+	entry.size = int64(len(resp.String()) + len(body))
+	entry.Expires = entry.expiresAt()
+
+	return entry, nil
+}
+
+// TieredStorage keeps the recently used responses of a slower Storage in a
+// faster Storage such as memory. Every response is written to both.
+type TieredStorage struct {
+	front Storage
+	back  Storage
+}
+
+// NewTieredStorage returns a TieredStorage which reads responses from the front
+// Storage before the back Storage.
+func NewTieredStorage(front Storage, back Storage) (storage *TieredStorage) {
+	return &TieredStorage{front: front, back: back}
+}
+
+// Get returns the variant from the front Storage if it is there otherwise it
+// is read from the back Storage and added to the front Storage.
+func (storage *TieredStorage) Get(
+	reqURL string,
+	reqHeaders http.Headers,
+) (entry *Entry, ok bool, err error) {
+	entry, ok, err = storage.front.Get(reqURL, reqHeaders)
+	if ok || err != nil {
+		return entry, ok, err
+	}
+
+	entry, ok, err = storage.back.Get(reqURL, reqHeaders)
+	if !ok || err != nil {
+		return entry, ok, err
+	}
+
+	return entry, true, storage.front.Put(reqURL, entry)
+}
+
+// Variants returns the variants in the back Storage which holds every
+// response.
+func (storage *TieredStorage) Variants(reqURL string) (entries []*Entry, err error) {
+	return storage.back.Variants(reqURL)
+}
+
+// Put stores the entry in both Storages.
+func (storage *TieredStorage) Put(reqURL string, entry *Entry) (err error) {
+	err = storage.back.Put(reqURL, entry)
+	frontErr := storage.front.Put(reqURL, entry)
+	if err == nil {
+		err = frontErr
+	}
+
+	return err
+}
+
+// Delete removes every variant of the URL from both Storages. The responses
+// freed from the back Storage are returned as it holds every response.
+func (storage *TieredStorage) Delete(reqURL string) (freed Stats, err error) {
+	freed, err = storage.back.Delete(reqURL)
+	_, frontErr := storage.front.Delete(reqURL)
+	if err == nil {
+		err = frontErr
+	}
+
+	return freed, err
+}
+
+// DeleteVariant removes the variant of the URL from both Storages. The
+// responses freed from the back Storage are returned as it holds every
+// response.
+func (storage *TieredStorage) DeleteVariant(
+	reqURL string,
+	id string,
+) (freed Stats, err error) {
+	freed, err = storage.back.DeleteVariant(reqURL, id)
+	_, frontErr := storage.front.DeleteVariant(reqURL, id)
+	if err == nil {
+		err = frontErr
+	}
+
+	return freed, err
+}
+
+// setEvicted passes the function on to the back Storage which holds every
+// response. Responses evicted from the front Storage are still cached.
+func (storage *TieredStorage) setEvicted(evicted func(reqURL string, id string)) {
+	if back, ok := storage.back.(evictingStorage); ok {
+		back.setEvicted(evicted)
+	}
+}
+
+// Range iterates over the back Storage which holds every response.
+func (storage *TieredStorage) Range(
+	f func(reqURL string, numVariants int) bool,
+) (err error) {
+	return storage.back.Range(f)
+}
+
+// Stats returns the stats of the back Storage which holds every response.
+func (storage *TieredStorage) Stats() (stats Stats, err error) {
+	return storage.back.Stats()
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// maxVariants is the maximum number of variants stored for a URL. The oldest
+// variant is replaced once the limit is reached.
+const maxVariants = 16
+
+// variants are the cached responses for a URL. Each variant was selected by
+// the request headers named in its Vary header. The variants are guarded by the
+// cache lock.
+type variants struct {
+	entries []*Entry
+}
+
+// newVariants returns an empty list of variants.
+func newVariants() *variants {
+	return &variants{entries: []*Entry{}}
+}
+
+// varyHeaders returns the lower case names of the request headers listed in
+// the Vary header of a response.
+func varyHeaders(headers http.Headers) (names []string) {
+	names = []string{}
+	for _, name := range headers.List("Vary") {
+		names = append(names, strings.ToLower(name))
+	}
+
+	return names
+}
+
+// varyKey returns the normalised values of the request headers named. Values
+// are lower cased, whitespace is removed from around commas and repeated
+// headers are combined so that equivalent requests have the same key.
+func varyKey(reqHeaders http.Headers, names []string) (key string) {
+	var builder strings.Builder
+	for _, name := range names {
+		builder.WriteString(name)
+		builder.WriteString(":")
+		elems := []string{}
+		for _, value := range reqHeaders.Values(name) {
+			for _, elem := range strings.Split(value, ",") {
+				elem = strings.Join(strings.Fields(elem), " ")
+				elems = append(elems, strings.ToLower(elem))
+			}
+		}
+		builder.WriteString(strings.Join(elems, ","))
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// matches reports whether the cached response can be used for a request with
+// the headers specified.
+func (entry *Entry) matches(reqHeaders http.Headers) bool {
+	return varyKey(reqHeaders, entry.Vary) == entry.VaryKey
+}
+
+// get returns the most recently stored variant which matches the request
+// headers.
+func (variants *variants) get(reqHeaders http.Headers) (entry *Entry, ok bool) {
+	for i := len(variants.entries) - 1; i >= 0; i-- {
+		if variants.entries[i].matches(reqHeaders) {
+			return variants.entries[i], true
+		}
+	}
+
+	return &Entry{}, false
+}
+
+// put stores a variant replacing any variant selected by the same request
+// headers. The variants which were replaced are returned.
+func (variants *variants) put(entry *Entry) (replaced []*Entry) {
+	replaced = []*Entry{}
+	kept := variants.entries[:0]
+	for _, variant := range variants.entries {
+		if variant.VaryKey != entry.VaryKey ||
+			strings.Join(variant.Vary, ",") != strings.Join(entry.Vary, ",") {
+			kept = append(kept, variant)
+		} else {
+			replaced = append(replaced, variant)
+		}
+	}
+	if len(kept) >= maxVariants {
+		replaced = append(replaced, kept[0])
+		kept = kept[1:]
+	}
+	variants.entries = append(kept, entry)
+
+	return replaced
+}
+
+// remove removes the variant from the list.
+func (variants *variants) remove(entry *Entry) {
+	for i, variant := range variants.entries {
+		if variant == entry {
+			variants.entries = append(variants.entries[:i], variants.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// len returns the number of variants stored.
+func (variants *variants) len() (n int) {
+	return len(variants.entries)
+}
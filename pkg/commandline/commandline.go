@@ -7,12 +7,17 @@ import (
 	"strings"
 	"sync"
 
+	cachepkg "github.com/lexesjan/go-web-proxy-server/pkg/cache"
 	"github.com/lexesjan/go-web-proxy-server/pkg/log"
 	"github.com/lexesjan/go-web-proxy-server/pkg/metrics"
 )
 
 // Dispatcher handles the user input
-func Dispatcher(blockList *sync.Map, metrics *metrics.Metrics) {
+func Dispatcher(
+	blockList *sync.Map,
+	cache *cachepkg.Cache,
+	metrics *metrics.Metrics,
+) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Printf("\r%s", log.Prompt)
@@ -59,6 +64,135 @@ func Dispatcher(blockList *sync.Map, metrics *metrics.Metrics) {
 				}
 
 				fmt.Println(metrics)
+			case "cache":
+				usage := "usage: cache [list [host] | show <url> | stats]\n"
+				if len(tokens) == 1 {
+					fmt.Println(cache)
+					continue
+				}
+
+				switch subcommand := tokens[1]; {
+				case subcommand == "list" && len(tokens) <= 3:
+					host := ""
+					if len(tokens) == 3 {
+						host = tokens[2]
+					}
+					fmt.Println(cache.List(host))
+				case subcommand == "show" && len(tokens) == 3:
+					fmt.Println(cache.Show(tokens[2]))
+				case subcommand == "stats" && len(tokens) == 2:
+					fmt.Println(cache.Summary())
+				default:
+					fmt.Fprint(os.Stderr, usage)
+				}
+			case "purge":
+				if len(tokens) == 1 || len(tokens) > 2 {
+					fmt.Fprintf(os.Stderr, "usage: purge <url>\n")
+					continue
+				}
+
+				freed, err := cache.Purge(tokens[1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+					continue
+				}
+				fmt.Printf(
+					"%s: freed %d entries, %d bytes\n",
+					command,
+					freed.Entries,
+					freed.Size,
+				)
+			case "purge-host":
+				if len(tokens) == 1 || len(tokens) > 2 {
+					fmt.Fprintf(os.Stderr, "usage: purge-host <host>\n")
+					continue
+				}
+
+				freed, err := cache.PurgeHost(tokens[1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+					continue
+				}
+				fmt.Printf(
+					"%s: freed %d entries, %d bytes\n",
+					command,
+					freed.Entries,
+					freed.Size,
+				)
+			case "purge-prefix":
+				if len(tokens) == 1 || len(tokens) > 2 {
+					fmt.Fprintf(os.Stderr, "usage: purge-prefix <url prefix>\n")
+					continue
+				}
+
+				freed, err := cache.PurgePrefix(tokens[1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+					continue
+				}
+				fmt.Printf(
+					"%s: freed %d entries, %d bytes\n",
+					command,
+					freed.Entries,
+					freed.Size,
+				)
+			case "rule":
+				usage := "usage: rule [add <pattern> <option>... | remove <pattern>]\n"
+				if len(tokens) == 1 {
+					rules := cache.Rules()
+					fmt.Printf("%s: %d rules\n", command, len(rules))
+					for _, rule := range rules {
+						fmt.Printf("    - %s\n", rule)
+					}
+					continue
+				}
+
+				switch subcommand := tokens[1]; {
+				case subcommand == "add" && len(tokens) >= 4:
+					rule, err := cachepkg.ParseRule(strings.Join(tokens[2:], " "))
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+						continue
+					}
+					if cache.AddRule(rule) {
+						fmt.Printf("%s: replaced %q\n", command, rule.String())
+					} else {
+						fmt.Printf("%s: added %q\n", command, rule.String())
+					}
+				case subcommand == "remove" && len(tokens) == 3:
+					pattern := tokens[2]
+					if cache.RemoveRule(pattern) {
+						fmt.Printf("%s: removed %q\n", command, pattern)
+					} else {
+						fmt.Fprintf(os.Stderr, "%s: rule %q not found\n", command, pattern)
+					}
+				default:
+					fmt.Fprint(os.Stderr, usage)
+				}
+			case "offline":
+				if len(tokens) > 1 {
+					fmt.Fprintf(os.Stderr, "usage: offline\n")
+					continue
+				}
+
+				if cache.Offline() {
+					fmt.Fprintf(os.Stderr, "%s: already offline\n", command)
+					continue
+				}
+				cache.SetOffline(true)
+				fmt.Printf("%s: only answering requests from the cache\n", command)
+			case "online":
+				if len(tokens) > 1 {
+					fmt.Fprintf(os.Stderr, "usage: online\n")
+					continue
+				}
+
+				if !cache.Offline() {
+					fmt.Fprintf(os.Stderr, "%s: already online\n", command)
+					continue
+				}
+				cache.SetOffline(false)
+				fmt.Printf("%s: forwarding requests to host servers\n", command)
 			case "clear":
 				if len(tokens) > 1 {
 					fmt.Fprintf(os.Stderr, "usage: clear\n")
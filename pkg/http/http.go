@@ -2,56 +2,443 @@ package http
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"net/http/httputil"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// Headers is string key value map of the HTTP headers
-type Headers map[string]string
+// Header is a single HTTP header field.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Headers is the list of HTTP header fields in a HTTP message. The fields are
+// kept in the order they were received and their names keep their original
+// casing. Header names are matched case-insensitively.
+type Headers []Header
+
+// Get returns the first value associated with the header name. An empty string
+// is returned if there is no such header.
+func (headers Headers) Get(name string) (value string) {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+
+	return ""
+}
+
+// Has reports whether a header with the header name exists.
+func (headers Headers) Has(name string) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Values returns all the values associated with the header name in the order
+// they were received.
+func (headers Headers) Values(name string) (values []string) {
+	values = []string{}
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			values = append(values, header.Value)
+		}
+	}
+
+	return values
+}
+
+// Add appends a header field to the end of the headers.
+func (headers *Headers) Add(name, value string) {
+	*headers = append(*headers, Header{Name: name, Value: value})
+}
+
+// Set replaces the value of the first header with the header name and removes
+// any other headers with the same name. The header is appended if it does not
+// exist.
+func (headers *Headers) Set(name, value string) {
+	set := false
+	kept := (*headers)[:0]
+	for _, header := range *headers {
+		if strings.EqualFold(header.Name, name) {
+			if set {
+				continue
+			}
+			header.Value = value
+			set = true
+		}
+		kept = append(kept, header)
+	}
+	*headers = kept
+
+	if !set {
+		headers.Add(name, value)
+	}
+}
+
+// Del removes all the headers with the header name.
+func (headers *Headers) Del(name string) {
+	kept := (*headers)[:0]
+	for _, header := range *headers {
+		if !strings.EqualFold(header.Name, name) {
+			kept = append(kept, header)
+		}
+	}
+	*headers = kept
+}
+
+// Clone returns a copy of the headers.
+func (headers Headers) Clone() (clone Headers) {
+	clone = make(Headers, len(headers))
+	copy(clone, headers)
+
+	return clone
+}
+
+// List returns the comma separated elements of all the values associated with
+// the header name. Empty elements are omitted.
+func (headers Headers) List(name string) (list []string) {
+	list = []string{}
+	for _, value := range headers.Values(name) {
+		for _, elem := range strings.Split(value, ",") {
+			elem = strings.TrimSpace(elem)
+			if elem != "" {
+				list = append(list, elem)
+			}
+		}
+	}
+
+	return list
+}
 
 // CacheControl parses the Cache-Control header
-func (headers *Headers) CacheControl() (cacheControl []string) {
-	rawCacheControl, ok := (*headers)["Cache-Control"]
-	cacheControl = []string{}
-	if ok {
-		cacheControl = strings.Split(rawCacheControl, ", ")
+func (headers Headers) CacheControl() (cacheControl []string) {
+	return headers.List("Cache-Control")
+}
+
+// CacheControlDirective returns the value of a Cache-Control directive. The ok
+// result indicates whether the directive is present. Directive names are
+// matched case-insensitively and quotes around the value are removed.
+func (headers Headers) CacheControlDirective(name string) (value string, ok bool) {
+	for _, directive := range headers.CacheControl() {
+		directiveName := directive
+		directiveValue := ""
+		if equals := strings.IndexByte(directive, '='); equals >= 0 {
+			directiveName = strings.TrimSpace(directive[:equals])
+			directiveValue = strings.Trim(strings.TrimSpace(directive[equals+1:]), "\"")
+		}
+		if strings.EqualFold(directiveName, name) {
+			return directiveValue, true
+		}
+	}
+
+	return "", false
+}
+
+// hopByHopHeaders are the headers which only apply to a single connection and
+// must not be forwarded by proxies.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Upgrade",
+}
+
+// RemoveHopByHop removes the hop-by-hop headers along with any headers listed
+// in the Connection header. Content-Length and Transfer-Encoding are kept as
+// the body is forwarded with the same framing.
+func (headers *Headers) RemoveHopByHop() {
+	for _, name := range headers.List("Connection") {
+		if !strings.EqualFold(name, "Content-Length") &&
+			!strings.EqualFold(name, "Transfer-Encoding") {
+			headers.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		headers.Del(name)
+	}
+}
+
+// Chunked reports whether the final transfer coding is chunked.
+func (headers Headers) Chunked() bool {
+	transferEncoding := headers.List("Transfer-Encoding")
+	if len(transferEncoding) == 0 {
+		return false
+	}
+
+	return strings.EqualFold(transferEncoding[len(transferEncoding)-1], "chunked")
+}
+
+// checkFraming checks the headers which delimit the body of a message as
+// defined by RFC 7230 section 3.3.3 and returns the length given by the
+// Content-Length header, or -1 if the length is not given. Content-Length is
+// removed if Transfer-Encoding is present as the transfer coding delimits the
+// body, so that the two are never forwarded together. Repeated Content-Length
+// values which are the same are merged into one header. An error is returned
+// if the values differ or are not a length. Requests whose final transfer
+// coding is not chunked are rejected as their body can't be delimited.
+func (headers *Headers) checkFraming(request bool) (contentLength int64, err error) {
+	if headers.Has("Transfer-Encoding") {
+		headers.Del("Content-Length")
+		if request && !headers.Chunked() {
+			return -1, fmt.Errorf(
+				"unsupported Transfer-Encoding %q",
+				headers.Values("Transfer-Encoding"),
+			)
+		}
+		return -1, nil
+	}
+	if !headers.Has("Content-Length") {
+		return -1, nil
+	}
+
+	values := headers.List("Content-Length")
+	for _, value := range values {
+		if value != values[0] {
+			return -1, fmt.Errorf("conflicting Content-Length %q", values)
+		}
+	}
+	if len(values) == 0 || strings.TrimLeft(values[0], "0123456789") != "" {
+		return -1, fmt.Errorf("invalid Content-Length %q", values)
+	}
+	contentLength, err = strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid Content-Length %q", values)
 	}
+	headers.Set("Content-Length", values[0])
 
-	return cacheControl
+	return contentLength, nil
 }
 
 // ReadHeaders will parse the HTTP headers in a HTTP message. The reader must
 // have already read the HTTP status line prior to calling this function.
+// io.ErrUnexpectedEOF is returned if the reader ends before the blank line
+// which ends the headers.
 func ReadHeaders(reader *bufio.Reader) (headers Headers, err error) {
-	headers = make(map[string]string)
+	headers = Headers{}
 
 	for {
 		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return Headers{}, io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-				return make(map[string]string), err
-			}
-			break
+			return Headers{}, err
 		}
 		trimmed := strings.TrimRight(line, "\r\n")
 		// End of headers, start of body.
 		if trimmed == "" {
 			break
 		}
-		header := strings.Split(trimmed, ": ")
-		headers[standardiseHeaderKey(header[0])] = header[1]
+		// Obsolete line folding continues the previous header value. The fold
+		// is replaced with a single space.
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if len(headers) == 0 {
+				return Headers{}, fmt.Errorf("malformed header line %q", trimmed)
+			}
+			last := &headers[len(headers)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(trimmed))
+			continue
+		}
+		colon := strings.IndexByte(trimmed, ':')
+		if colon <= 0 || strings.ContainsAny(trimmed[:colon], " \t") {
+			return Headers{}, fmt.Errorf("malformed header line %q", trimmed)
+		}
+		headers.Add(trimmed[:colon], strings.TrimSpace(trimmed[colon+1:]))
 	}
 
-	return headers, err
+	return headers, nil
 }
 
-func standardiseHeaderKey(headerKey string) (standarisedKey string) {
-	standarisedKey = strings.Title(headerKey)
-	return standarisedKey
+// writeHeaders writes the header fields in order.
+func writeHeaders(w io.Writer, headers Headers) {
+	for _, header := range headers {
+		fmt.Fprintf(w, "%s: %s\r\n", header.Name, header.Value)
+	}
 }
 
 // TimeFormat is an example of the HTTP date format. It can be used in the
 // ParseTime function.
 const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// timeFormats are the HTTP date formats which must be accepted. Only
+// TimeFormat should be generated.
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ParseTime parses a HTTP date in any of the formats allowed by RFC 7231.
+func ParseTime(text string) (t time.Time, err error) {
+	for _, layout := range timeFormats {
+		t, err = time.Parse(layout, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+// NoBody is the body of a HTTP message without a body. Reading it always
+// returns io.EOF.
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+func (noBody) Close() (err error) {
+	return nil
+}
+
+// chunkedBody decodes a chunked body. The trailer section after the last chunk
+// is read and discarded so that the next message can be read from the reader.
+type chunkedBody struct {
+	reader  *bufio.Reader
+	chunked io.Reader
+	done    bool
+}
+
+func newChunkedBody(reader *bufio.Reader) (body *chunkedBody) {
+	body = &chunkedBody{
+		reader:  reader,
+		chunked: httputil.NewChunkedReader(reader),
+	}
+
+	return body
+}
+
+func (body *chunkedBody) Read(p []byte) (n int, err error) {
+	if body.done {
+		return 0, io.EOF
+	}
+
+	n, err = body.chunked.Read(p)
+	if err == io.EOF {
+		body.done = true
+		_, err = ReadHeaders(body.reader)
+		if err != nil {
+			return n, err
+		}
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// contentLengthBody reads the bytes of a body delimited by its Content-Length.
+// Reading returns io.ErrUnexpectedEOF rather than io.EOF if the connection ends
+// before the whole body is read so that a body cut short is not mistaken for a
+// complete one.
+type contentLengthBody struct {
+	body      io.Reader
+	remaining int64
+}
+
+func newContentLengthBody(body io.Reader, n int64) (reader *contentLengthBody) {
+	return &contentLengthBody{body: body, remaining: n}
+}
+
+func (reader *contentLengthBody) Read(p []byte) (n int, err error) {
+	if reader.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+	n, err = reader.body.Read(p)
+	reader.remaining -= int64(n)
+	if err == io.EOF && reader.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && reader.remaining == 0 {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// ErrBodyTooLarge is returned when reading a body which is larger than the
+// limit set by MaxBytesReader.
+var ErrBodyTooLarge = errors.New("body too large")
+
+// MaxBytesReader returns a reader which reads at most n bytes from the body.
+// Reading more than n bytes returns ErrBodyTooLarge.
+func MaxBytesReader(body io.Reader, n int64) (reader io.Reader) {
+	return &maxBytesReader{body: body, remaining: n}
+}
+
+type maxBytesReader struct {
+	body      io.Reader
+	remaining int64
+}
+
+func (reader *maxBytesReader) Read(p []byte) (n int, err error) {
+	// Read one byte more than remaining to find out if the limit is exceeded.
+	if int64(len(p)) > reader.remaining+1 {
+		p = p[:reader.remaining+1]
+	}
+	n, err = reader.body.Read(p)
+	if int64(n) > reader.remaining {
+		n = int(reader.remaining)
+		reader.remaining = 0
+		return n, ErrBodyTooLarge
+	}
+	reader.remaining -= int64(n)
+
+	return n, err
+}
+
+// writeMessage writes the start line and headers of a HTTP message followed
+// by the body. The body is streamed and chunk encoded if the headers specify
+// a chunked transfer encoding. The number of bytes written is returned.
+func writeMessage(
+	w io.Writer,
+	head string,
+	headers Headers,
+	body io.Reader,
+) (n int64, err error) {
+	written, err := io.WriteString(w, head)
+	n = int64(written)
+	if err != nil || body == nil {
+		return n, err
+	}
+
+	if !headers.Chunked() {
+		copied, err := io.Copy(w, body)
+		return n + copied, err
+	}
+
+	chunkedWriter := httputil.NewChunkedWriter(w)
+	copied, err := io.Copy(chunkedWriter, body)
+	n += copied
+	if err != nil {
+		return n, err
+	}
+	// Write the last chunk followed by an empty trailer.
+	err = chunkedWriter.Close()
+	if err != nil {
+		return n, err
+	}
+	written, err = io.WriteString(w, "\r\n")
+
+	return n + int64(written), err
+}
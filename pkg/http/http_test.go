@@ -0,0 +1,260 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		headers Headers
+		err     error
+		// malformed is set if any error other than io.ErrUnexpectedEOF is
+		// expected.
+		malformed bool
+		rest      string
+	}{
+		{
+			name:    "order and casing are kept",
+			message: "X-B: 1\r\ncontent-type: text/html\r\nX-A: 2\r\n\r\nbody",
+			headers: Headers{
+				{Name: "X-B", Value: "1"},
+				{Name: "content-type", Value: "text/html"},
+				{Name: "X-A", Value: "2"},
+			},
+			rest: "body",
+		},
+		{
+			name:    "repeated headers",
+			message: "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n",
+			headers: Headers{
+				{Name: "Set-Cookie", Value: "a=1"},
+				{Name: "Set-Cookie", Value: "b=2"},
+			},
+		},
+		{
+			name:    "whitespace around the value",
+			message: "Host:   www.example.com  \r\n\r\n",
+			headers: Headers{{Name: "Host", Value: "www.example.com"}},
+		},
+		{
+			name:    "bare line feeds",
+			message: "Host: www.example.com\n\n",
+			headers: Headers{{Name: "Host", Value: "www.example.com"}},
+		},
+		{
+			name:    "obsolete line folding",
+			message: "X-Long: first\r\n  second\r\n\tthird\r\n\r\n",
+			headers: Headers{{Name: "X-Long", Value: "first second third"}},
+		},
+		{
+			name:    "no headers",
+			message: "\r\nbody",
+			headers: Headers{},
+			rest:    "body",
+		},
+		{
+			name:      "folding without a header",
+			message:   " folded\r\n\r\n",
+			malformed: true,
+		},
+		{
+			name:      "no colon",
+			message:   "Host www.example.com\r\n\r\n",
+			malformed: true,
+		},
+		{
+			name:      "whitespace before the colon",
+			message:   "Host : www.example.com\r\n\r\n",
+			malformed: true,
+		},
+		{
+			name:    "connection closed before the blank line",
+			message: "Host: www.example.com\r\n",
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "connection closed within a line",
+			message: "Host: www.exa",
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "connection closed before any headers",
+			message: "",
+			err:     io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.message))
+			headers, err := ReadHeaders(reader)
+			switch {
+			case test.malformed:
+				if err == nil || err == io.ErrUnexpectedEOF {
+					t.Fatalf("ReadHeaders() error = %v, want a malformed header error", err)
+				}
+				return
+			case err != test.err:
+				t.Fatalf("ReadHeaders() error = %v, want %v", err, test.err)
+			case err != nil:
+				return
+			}
+			if !reflect.DeepEqual(headers, test.headers) {
+				t.Errorf("ReadHeaders() = %q, want %q", headers, test.headers)
+			}
+			rest, _ := reader.ReadString(0)
+			if rest != test.rest {
+				t.Errorf("left %q unread, want %q", rest, test.rest)
+			}
+		})
+	}
+}
+
+func TestHeadersSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers Headers
+		want    Headers
+	}{
+		{
+			name:    "appended if missing",
+			headers: Headers{{Name: "Host", Value: "www.example.com"}},
+			want: Headers{
+				{Name: "Host", Value: "www.example.com"},
+				{Name: "Cache-Control", Value: "no-cache"},
+			},
+		},
+		{
+			name: "first kept in place with its casing",
+			headers: Headers{
+				{Name: "cache-control", Value: "max-age=60"},
+				{Name: "Host", Value: "www.example.com"},
+			},
+			want: Headers{
+				{Name: "cache-control", Value: "no-cache"},
+				{Name: "Host", Value: "www.example.com"},
+			},
+		},
+		{
+			name: "others removed",
+			headers: Headers{
+				{Name: "Cache-Control", Value: "max-age=60"},
+				{Name: "Host", Value: "www.example.com"},
+				{Name: "CACHE-CONTROL", Value: "public"},
+			},
+			want: Headers{
+				{Name: "Cache-Control", Value: "no-cache"},
+				{Name: "Host", Value: "www.example.com"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := test.headers.Clone()
+			headers.Set("Cache-Control", "no-cache")
+			if !reflect.DeepEqual(headers, test.want) {
+				t.Errorf("Set() = %q, want %q", headers, test.want)
+			}
+		})
+	}
+}
+
+func TestHeadersDel(t *testing.T) {
+	headers := Headers{
+		{Name: "Warning", Value: `110 - "Response is Stale"`},
+		{Name: "Host", Value: "www.example.com"},
+		{Name: "warning", Value: `112 - "Disconnected Operation"`},
+	}
+	clone := headers.Clone()
+
+	headers.Del("WARNING")
+	want := Headers{{Name: "Host", Value: "www.example.com"}}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("Del() = %q, want %q", headers, want)
+	}
+	if len(clone) != 3 || clone[2].Name != "warning" {
+		t.Errorf("Del() changed the clone to %q", clone)
+	}
+}
+
+func TestHeadersValues(t *testing.T) {
+	headers := Headers{
+		{Name: "Cache-Control", Value: "max-age=60, ,public"},
+		{Name: "Host", Value: "www.example.com"},
+		{Name: "cache-control", Value: `private="Set-Cookie"`},
+	}
+
+	if value := headers.Get("CACHE-CONTROL"); value != "max-age=60, ,public" {
+		t.Errorf("Get() = %q, want the first value", value)
+	}
+	if value := headers.Get("Age"); value != "" || headers.Has("Age") {
+		t.Errorf("Get() = %q for a missing header", value)
+	}
+	values := headers.Values("Cache-Control")
+	wantValues := []string{"max-age=60, ,public", `private="Set-Cookie"`}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("Values() = %q, want %q", values, wantValues)
+	}
+	list := headers.List("Cache-Control")
+	wantList := []string{"max-age=60", "public", `private="Set-Cookie"`}
+	if !reflect.DeepEqual(list, wantList) {
+		t.Errorf("List() = %q, want %q", list, wantList)
+	}
+	if value, ok := headers.CacheControlDirective("Private"); !ok || value != "Set-Cookie" {
+		t.Errorf("CacheControlDirective() = %q, %t, want Set-Cookie, true", value, ok)
+	}
+	if _, ok := headers.CacheControlDirective("no-store"); ok {
+		t.Error("CacheControlDirective() found a missing directive")
+	}
+}
+
+func TestRemoveHopByHop(t *testing.T) {
+	headers := Headers{
+		{Name: "Connection", Value: "keep-alive, X-Secret, Content-Length"},
+		{Name: "Keep-Alive", Value: "timeout=5"},
+		{Name: "X-Secret", Value: "1"},
+		{Name: "Content-Length", Value: "5"},
+		{Name: "Proxy-Authorization", Value: "Basic dXNlcjpwYXNz"},
+		{Name: "Host", Value: "www.example.com"},
+	}
+
+	headers.RemoveHopByHop()
+	want := Headers{
+		{Name: "Content-Length", Value: "5"},
+		{Name: "Host", Value: "www.example.com"},
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("RemoveHopByHop() = %q, want %q", headers, want)
+	}
+}
+
+func TestChunked(t *testing.T) {
+	tests := []struct {
+		transferEncoding []string
+		chunked          bool
+	}{
+		{nil, false},
+		{[]string{"chunked"}, true},
+		{[]string{"Chunked"}, true},
+		{[]string{"gzip, chunked"}, true},
+		{[]string{"gzip", "chunked"}, true},
+		{[]string{"chunked, gzip"}, false},
+	}
+
+	for _, test := range tests {
+		headers := Headers{}
+		for _, value := range test.transferEncoding {
+			headers.Add("Transfer-Encoding", value)
+		}
+		if chunked := headers.Chunked(); chunked != test.chunked {
+			t.Errorf("Chunked() of %q = %t, want %t", test.transferEncoding, chunked, test.chunked)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the most ranges a Range header may ask for. Headers with more
+// ranges are ignored so that a request can't make a response many times larger
+// than the representation.
+const maxRanges = 32
+
+// ErrUnsatisfiableRange is returned when none of the ranges asked for overlap
+// the representation.
+var ErrUnsatisfiableRange = errors.New("range not satisfiable")
+
+// ByteRange is a range of the bytes of a representation. Start is the offset
+// of the first byte and Length the number of bytes.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange returns the Content-Range header value of the range of a
+// representation of the size specified.
+func (byteRange ByteRange) ContentRange(size int64) (contentRange string) {
+	return fmt.Sprintf(
+		"bytes %d-%d/%d",
+		byteRange.Start,
+		byteRange.Start+byteRange.Length-1,
+		size,
+	)
+}
+
+// ParseRange parses a Range header value as defined by RFC 7233 section 3.1
+// for a representation of the size specified. Ranges which start past the end
+// of the representation are dropped and ranges which end past it are
+// shortened. The ranges are sorted and those which overlap or are adjacent are
+// merged as allowed by RFC 7233 section 4.1. ErrUnsatisfiableRange is returned
+// if every range is dropped. Any other error means the header is invalid or
+// asks for more bytes than the representation holds, and must be ignored.
+func ParseRange(value string, size int64) (ranges []ByteRange, err error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes=") {
+		return []ByteRange{}, fmt.Errorf("unsupported range %q", value)
+	}
+
+	specs := strings.Split(strings.TrimPrefix(value, "bytes="), ",")
+	if len(specs) > maxRanges {
+		return []ByteRange{}, fmt.Errorf("too many ranges in %q", value)
+	}
+	ranges = []ByteRange{}
+	numSpecs := 0
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		numSpecs++
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return []ByteRange{}, fmt.Errorf("malformed range %q", spec)
+		}
+		first := strings.TrimSpace(spec[:dash])
+		last := strings.TrimSpace(spec[dash+1:])
+
+		var byteRange ByteRange
+		if first == "" {
+			// A suffix range asks for the last bytes of the representation.
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return []ByteRange{}, fmt.Errorf("malformed range %q", spec)
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			byteRange = ByteRange{Start: size - suffix, Length: suffix}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return []ByteRange{}, fmt.Errorf("malformed range %q", spec)
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return []ByteRange{}, fmt.Errorf("malformed range %q", spec)
+				}
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			byteRange = ByteRange{Start: start, Length: end - start + 1}
+		}
+		ranges = append(ranges, byteRange)
+	}
+	if numSpecs == 0 {
+		return []ByteRange{}, fmt.Errorf("malformed range %q", value)
+	}
+	if len(ranges) == 0 {
+		return []ByteRange{}, ErrUnsatisfiableRange
+	}
+	total := int64(0)
+	for _, byteRange := range ranges {
+		total += byteRange.Length
+	}
+	if total > size {
+		return []ByteRange{}, fmt.Errorf("ranges in %q are larger than the representation", value)
+	}
+
+	return mergeRanges(ranges), nil
+}
+
+// mergeRanges sorts the ranges and merges those which overlap or are adjacent.
+func mergeRanges(ranges []ByteRange) (merged []ByteRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	merged = []ByteRange{ranges[0]}
+	for _, byteRange := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if byteRange.Start > last.Start+last.Length {
+			merged = append(merged, byteRange)
+			continue
+		}
+		if end := byteRange.Start + byteRange.Length; end > last.Start+last.Length {
+			last.Length = end - last.Start
+		}
+	}
+
+	return merged
+}
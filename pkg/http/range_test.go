@@ -0,0 +1,156 @@
+package http
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		size   int64
+		ranges []ByteRange
+		// err is set if any error other than ErrUnsatisfiableRange is
+		// expected.
+		err         bool
+		unsatisfied bool
+	}{
+		{
+			name:   "single range",
+			value:  "bytes=0-99",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 100}},
+		},
+		{
+			name:   "open range",
+			value:  "bytes=900-",
+			size:   1000,
+			ranges: []ByteRange{{Start: 900, Length: 100}},
+		},
+		{
+			name:   "suffix range",
+			value:  "bytes=-100",
+			size:   1000,
+			ranges: []ByteRange{{Start: 900, Length: 100}},
+		},
+		{
+			name:   "suffix longer than the representation",
+			value:  "bytes=-2000",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 1000}},
+		},
+		{
+			name:   "end past the representation",
+			value:  "bytes=900-1999",
+			size:   1000,
+			ranges: []ByteRange{{Start: 900, Length: 100}},
+		},
+		{
+			name:   "whitespace and empty elements",
+			value:  " bytes= 0-9 , , 20-29 ",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 10}, {Start: 20, Length: 10}},
+		},
+		{
+			name:   "sorted",
+			value:  "bytes=500-599,0-99",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 100}, {Start: 500, Length: 100}},
+		},
+		{
+			name:   "overlapping ranges merged",
+			value:  "bytes=0-99,50-149",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 150}},
+		},
+		{
+			name:   "adjacent ranges merged",
+			value:  "bytes=100-199,0-99,300-399",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 200}, {Start: 300, Length: 100}},
+		},
+		{
+			name:   "contained range merged",
+			value:  "bytes=0-499,100-199",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 500}},
+		},
+		{
+			name:   "range past the end dropped",
+			value:  "bytes=0-9,2000-2999",
+			size:   1000,
+			ranges: []ByteRange{{Start: 0, Length: 10}},
+		},
+		{
+			name:        "every range past the end",
+			value:       "bytes=1000-1999",
+			size:        1000,
+			unsatisfied: true,
+		},
+		{
+			name:        "empty suffix",
+			value:       "bytes=-0",
+			size:        1000,
+			unsatisfied: true,
+		},
+		{
+			name:        "empty representation",
+			value:       "bytes=0-9",
+			size:        0,
+			unsatisfied: true,
+		},
+		{
+			name:  "larger than the representation",
+			value: "bytes=0-599,400-999",
+			size:  1000,
+			err:   true,
+		},
+		{
+			name:  "repeated whole representation",
+			value: "bytes=0-,0-",
+			size:  1000,
+			err:   true,
+		},
+		{name: "other unit", value: "items=0-9", size: 1000, err: true},
+		{name: "no ranges", value: "bytes=", size: 1000, err: true},
+		{name: "no dash", value: "bytes=10", size: 1000, err: true},
+		{name: "end before start", value: "bytes=10-9", size: 1000, err: true},
+		{name: "negative start", value: "bytes=-5-9", size: 1000, err: true},
+		{name: "non-numeric", value: "bytes=a-b", size: 1000, err: true},
+		{
+			name:  "too many ranges",
+			value: "bytes=0-0" + strings.Repeat(",2-2", maxRanges),
+			size:  1000,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := ParseRange(test.value, test.size)
+			switch {
+			case test.unsatisfied:
+				if err != ErrUnsatisfiableRange {
+					t.Errorf("ParseRange() error = %v, want %v", err, ErrUnsatisfiableRange)
+				}
+			case test.err:
+				if err == nil || err == ErrUnsatisfiableRange {
+					t.Errorf("ParseRange() = %v, %v, want the header ignored", ranges, err)
+				}
+			case err != nil:
+				t.Errorf("ParseRange() error: %s", err)
+			case !reflect.DeepEqual(ranges, test.ranges):
+				t.Errorf("ParseRange() = %v, want %v", ranges, test.ranges)
+			}
+		})
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	byteRange := ByteRange{Start: 900, Length: 100}
+	if contentRange := byteRange.ContentRange(1000); contentRange != "bytes 900-999/1000" {
+		t.Errorf("ContentRange() = %q, want %q", contentRange, "bytes 900-999/1000")
+	}
+}
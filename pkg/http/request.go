@@ -2,43 +2,53 @@ package http
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	urlpkg "net/url"
 	"strconv"
 	"strings"
 )
 
-// Request represents a HTTP request.
+// TargetForm is the form of the request-target in a request line.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path and query e.g. /search?q=go
+	OriginForm TargetForm = iota
+	// AbsoluteForm is an absolute URI sent to proxies e.g.
+	// http://www.example.com/search?q=go
+	AbsoluteForm
+	// AuthorityForm is the host and port of a CONNECT request e.g.
+	// www.example.com:443
+	AuthorityForm
+	// AsteriskForm is the * of a server wide OPTIONS request.
+	AsteriskForm
+)
+
+// Request represents a HTTP request. The Target is in origin form unless the
+// request was received in authority or asterisk form. The Host header holds
+// the host of the request.
 type Request struct {
 	Method  string
-	Path    string
+	Target  string
+	Form    TargetForm
 	HTTPVer string
 	Headers Headers
-	Body    string
+	Body    io.Reader
 }
 
 // NewRequest returns a new Request created by reading the connection and
-// parsing the HTTP request message.
-func NewRequest(conn net.Conn) (req *Request, err error) {
-	reader := bufio.NewReader(conn)
-	method, path, httpVer, err := readRequestStatus(reader)
+// parsing the HTTP request message. The body is not read, it is streamed from
+// the connection when Body is read. The same reader must be used for every
+// request read from a persistent connection.
+func NewRequest(reader *bufio.Reader) (req *Request, err error) {
+	method, target, httpVer, err := readRequestStatus(reader)
 	if err != nil {
 		return &Request{}, err
 	}
 
-	// Proxy HTTP request.
-	if !strings.HasPrefix(path, "/") {
-		url, err := urlpkg.Parse(path)
-		if err != nil {
-			return &Request{}, err
-		}
-
-		path = url.Path
-	}
-
 	requestHeaders, err := ReadHeaders(reader)
 	if err != nil {
 		return &Request{}, err
@@ -46,40 +56,118 @@ func NewRequest(conn net.Conn) (req *Request, err error) {
 
 	req = &Request{
 		Method:  method,
-		Path:    path,
+		Target:  target,
 		HTTPVer: httpVer,
 		Headers: requestHeaders,
-		Body:    "",
+		Body:    nil,
+	}
+
+	err = req.parseTarget()
+	if err != nil {
+		return &Request{}, err
+	}
+
+	contentLength, err := req.Headers.checkFraming(true)
+	if err != nil {
+		return &Request{}, err
+	}
+
+	// Stream body if exists.
+	if req.Headers.Chunked() {
+		req.Body = newChunkedBody(reader)
+	} else if contentLength >= 0 {
+		req.Body = newContentLengthBody(reader, contentLength)
 	}
 
-	// Parse body if exists.
-	if _, ok := requestHeaders["Content-Length"]; ok {
-		contentLength, err := strconv.ParseInt(
-			requestHeaders["Content-Length"],
-			10,
-			0,
-		)
+	return req, nil
+}
+
+// parseTarget finds the form of the request-target and converts absolute form
+// targets to origin form. The host of an absolute or authority form target
+// replaces the Host header.
+func (req *Request) parseTarget() (err error) {
+	hosts := req.Headers.Values("Host")
+	if len(hosts) > 1 {
+		return fmt.Errorf("multiple Host headers %q", hosts)
+	}
+
+	switch {
+	case req.Method == "CONNECT":
+		_, _, err = net.SplitHostPort(req.Target)
 		if err != nil {
-			return &Request{}, err
+			return err
 		}
-
-		body, err := ioutil.ReadAll(io.LimitReader(
-			reader,
-			contentLength,
-		))
+		req.Form = AuthorityForm
+		req.Headers.Set("Host", req.Target)
+	case req.Target == "*":
+		if req.Method != "OPTIONS" {
+			return fmt.Errorf("%s request with * request-target", req.Method)
+		}
+		req.Form = AsteriskForm
+	case strings.HasPrefix(req.Target, "/"):
+		req.Form = OriginForm
+	default:
+		// Proxy HTTP request.
+		url, err := urlpkg.Parse(req.Target)
 		if err != nil {
-			return &Request{}, err
+			return err
+		}
+		if url.Scheme != "http" || url.Host == "" || url.Opaque != "" {
+			return fmt.Errorf("unsupported request-target %q", req.Target)
+		}
+
+		req.Form = AbsoluteForm
+		req.Target = url.RequestURI()
+		// A server wide OPTIONS request is sent to a proxy without a path.
+		if req.Method == "OPTIONS" && url.EscapedPath() == "" &&
+			url.RawQuery == "" {
+			req.Target = "*"
 		}
+		req.Headers.Set("Host", url.Host)
+	}
 
-		req.Body = string(body)
+	host := req.Headers.Get("Host")
+	if !req.Headers.Has("Host") {
+		if req.HTTPVer == "HTTP/1.1" {
+			return errors.New("missing Host header")
+		}
+		return nil
+	}
+	url, err := urlpkg.Parse("http://" + host)
+	if err != nil || url.Host != host || url.User != nil || url.Path != "" {
+		return fmt.Errorf("invalid Host header %q", host)
 	}
 
-	return req, nil
+	return nil
+}
+
+// URL returns the absolute URL of the request.
+func (req *Request) URL() (url string) {
+	if req.Target == "*" {
+		return fmt.Sprintf("http://%s", req.Headers.Get("Host"))
+	}
+
+	return fmt.Sprintf("http://%s%s", req.Headers.Get("Host"), req.Target)
+}
+
+// ContentLength returns the length of the body given by the Content-Length
+// header. -1 is returned if the length is unknown.
+func (req *Request) ContentLength() (contentLength int64) {
+	if req.Headers.Chunked() || !req.Headers.Has("Content-Length") {
+		return -1
+	}
+
+	contentLength, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 0)
+	if err != nil {
+		return -1
+	}
+
+	return contentLength
 }
 
 func readRequestStatus(reader *bufio.Reader) (
 	method,
-	url,
+	target,
 	httpVer string,
 	err error,
 ) {
@@ -90,13 +178,38 @@ func readRequestStatus(reader *bufio.Reader) (
 
 	trimmed := strings.TrimRight(statusLine, "\r\n")
 	status := strings.Split(trimmed, " ")
+	if len(status) != 3 {
+		return "", "", "", fmt.Errorf("malformed request line %q", trimmed)
+	}
 	method = status[0]
-	url = status[1]
+	target = status[1]
 	httpVer = status[2]
 
-	return method, url, httpVer, nil
+	return method, target, httpVer, nil
 }
 
+// KeepAlive reports whether the client wants the connection to persist after
+// the request. HTTP/1.1 connections persist unless the client asks for them to
+// be closed whereas HTTP/1.0 connections must ask for keep-alive.
+func (req *Request) KeepAlive() bool {
+	connection := append(
+		req.Headers.List("Connection"),
+		req.Headers.List("Proxy-Connection")...,
+	)
+	keepAlive := req.HTTPVer != "HTTP/1.0"
+	for _, option := range connection {
+		if strings.EqualFold(option, "close") {
+			return false
+		}
+		if strings.EqualFold(option, "keep-alive") {
+			keepAlive = true
+		}
+	}
+
+	return keepAlive
+}
+
+// String returns the request line and headers of the request.
 func (req *Request) String() (str string) {
 	var builder strings.Builder
 
@@ -104,12 +217,15 @@ func (req *Request) String() (str string) {
 		return builder.String()
 	}
 
-	fmt.Fprintf(&builder, "%s %s %s\r\n", req.Method, req.Path, req.HTTPVer)
-	for k, v := range req.Headers {
-		fmt.Fprintf(&builder, "%s: %s\r\n", k, v)
-	}
+	fmt.Fprintf(&builder, "%s %s %s\r\n", req.Method, req.Target, req.HTTPVer)
+	writeHeaders(&builder, req.Headers)
 	fmt.Fprint(&builder, "\r\n")
-	fmt.Fprint(&builder, req.Body)
 
 	return builder.String()
 }
+
+// WriteTo writes the request message to w, streaming the body if it exists.
+// The number of bytes written is returned.
+func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+	return writeMessage(w, req.String(), req.Headers, req.Body)
+}
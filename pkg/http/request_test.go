@@ -0,0 +1,137 @@
+package http
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const testRequestLine = "POST http://www.example.com/upload HTTP/1.1\r\nHost: www.example.com\r\n"
+
+func TestNewRequestFraming(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       string
+		body          string
+		ok            bool
+		contentLength string
+		read          string
+	}{
+		{
+			name:          "Content-Length",
+			headers:       "Content-Length: 5\r\n",
+			body:          "hello",
+			ok:            true,
+			contentLength: "5",
+			read:          "hello",
+		},
+		{
+			name:          "repeated Content-Length",
+			headers:       "Content-Length: 5\r\nContent-Length: 5\r\n",
+			body:          "hello",
+			ok:            true,
+			contentLength: "5",
+			read:          "hello",
+		},
+		{
+			name:          "Content-Length list",
+			headers:       "Content-Length: 5, 5\r\n",
+			body:          "hello",
+			ok:            true,
+			contentLength: "5",
+			read:          "hello",
+		},
+		{
+			name:    "conflicting Content-Length",
+			headers: "Content-Length: 5\r\nContent-Length: 6\r\n",
+			body:    "hello!",
+		},
+		{
+			name:    "conflicting Content-Length list",
+			headers: "Content-Length: 5, 6\r\n",
+			body:    "hello!",
+		},
+		{
+			name:    "negative Content-Length",
+			headers: "Content-Length: -5\r\n",
+		},
+		{
+			name:    "signed Content-Length",
+			headers: "Content-Length: +5\r\n",
+			body:    "hello",
+		},
+		{
+			name:    "non-numeric Content-Length",
+			headers: "Content-Length: five\r\n",
+			body:    "hello",
+		},
+		{
+			name:    "empty Content-Length",
+			headers: "Content-Length: \r\n",
+		},
+		{
+			name:    "Content-Length and chunked",
+			headers: "Content-Length: 3\r\nTransfer-Encoding: chunked\r\n",
+			body:    "5\r\nhello\r\n0\r\n\r\n",
+			ok:      true,
+			read:    "hello",
+		},
+		{
+			name:    "final transfer coding not chunked",
+			headers: "Transfer-Encoding: chunked, gzip\r\n",
+			body:    "hello",
+		},
+		{
+			name:    "transfer coding without chunked",
+			headers: "Transfer-Encoding: gzip\r\nContent-Length: 5\r\n",
+			body:    "hello",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := testRequestLine + test.headers + "\r\n" + test.body
+			req, err := NewRequest(bufio.NewReader(strings.NewReader(message)))
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("NewRequest() accepted %q", test.headers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewRequest() error: %s", err)
+			}
+			values := strings.Join(req.Headers.Values("Content-Length"), "|")
+			if values != test.contentLength {
+				t.Errorf("Content-Length = %q, want %q", values, test.contentLength)
+			}
+			read, err := ioutil.ReadAll(req.Body)
+			if err != nil || string(read) != test.read {
+				t.Errorf("read %q, %v, want %q", read, err, test.read)
+			}
+		})
+	}
+}
+
+// TestRequestForwardedFraming checks that a request sent with both
+// Content-Length and a chunked Transfer-Encoding is written back out with only
+// the chunked framing.
+func TestRequestForwardedFraming(t *testing.T) {
+	message := testRequestLine +
+		"Content-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+	req, err := NewRequest(bufio.NewReader(strings.NewReader(message)))
+	if err != nil {
+		t.Fatalf("NewRequest() error: %s", err)
+	}
+
+	var builder strings.Builder
+	if _, err := req.WriteTo(&builder); err != nil {
+		t.Fatalf("WriteTo() error: %s", err)
+	}
+	want := "POST /upload HTTP/1.1\r\nHost: www.example.com\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+	if builder.String() != want {
+		t.Errorf("WriteTo() wrote %q, want %q", builder.String(), want)
+	}
+}
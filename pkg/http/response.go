@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
-	"net/http/httputil"
 	"strconv"
 	"strings"
 )
@@ -16,14 +14,20 @@ type Response struct {
 	StatusCode        int
 	StatusDescription string
 	Headers           Headers
-	Body              string
+	Body              io.ReadCloser
 	HTTPVer           string
+	// noBody is set for responses to HEAD requests which have no body
+	// regardless of their headers.
+	noBody bool
 }
 
 // NewResponse returns a new Response created by reading the connection and
-// parsing the HTTP response message.
-func NewResponse(conn net.Conn) (resp *Response, err error) {
-	reader := bufio.NewReader(conn)
+// parsing the HTTP response message to a request with the method specified.
+// Interim 1xx responses other than 101 Switching Protocols are skipped. The
+// body is streamed from the reader when Body is read. Closing Body does not
+// close the connection. The same reader must be used for every response read
+// from a persistent connection.
+func NewResponse(reader *bufio.Reader, method string) (resp *Response, err error) {
 	httpVer, statusCode, statusDescription, err := readResponseStatus(reader)
 	if err != nil {
 		return &Response{}, err
@@ -34,36 +38,32 @@ func NewResponse(conn net.Conn) (resp *Response, err error) {
 		return &Response{}, err
 	}
 
+	if statusCode >= 100 && statusCode < 200 && statusCode != 101 {
+		return NewResponse(reader, method)
+	}
+
+	contentLength, err := responseHeaders.checkFraming(false)
+	if err != nil {
+		return &Response{}, err
+	}
+
 	resp = &Response{
 		StatusCode:        statusCode,
 		StatusDescription: statusDescription,
 		Headers:           responseHeaders,
-		Body:              "",
+		Body:              ioutil.NopCloser(reader),
 		HTTPVer:           httpVer,
+		noBody:            method == "HEAD",
 	}
 
-	// Parse Body if exists
-	if _, ok := responseHeaders["Content-Length"]; ok {
-		contentLength, err := strconv.ParseInt(
-			responseHeaders["Content-Length"],
-			10,
-			0,
-		)
-		if err != nil {
-			return &Response{}, err
-		}
-		body, err := ioutil.ReadAll(io.LimitReader(reader, contentLength))
-		if err != nil {
-			return &Response{}, err
-		}
-		resp.Body = string(body)
-	} else if responseHeaders["Transfer-Encoding"] == "chunked" {
-		delete(responseHeaders, "Transfer-Encoding")
-		body, err := ioutil.ReadAll(httputil.NewChunkedReader(reader))
-		if err != nil {
-			return &Response{}, err
-		}
-		resp.Body = string(body)
+	// Stream body if exists. Responses without a Content-Length or chunked
+	// transfer encoding are delimited by the server closing the connection.
+	if !resp.HasBody() {
+		resp.Body = NoBody
+	} else if responseHeaders.Chunked() {
+		resp.Body = ioutil.NopCloser(newChunkedBody(reader))
+	} else if contentLength >= 0 {
+		resp.Body = ioutil.NopCloser(newContentLengthBody(reader, contentLength))
 	}
 
 	return resp, nil
@@ -82,6 +82,9 @@ func readResponseStatus(reader *bufio.Reader) (
 
 	trimmed := strings.TrimRight(statusLine, "\r\n")
 	status := strings.Split(trimmed, " ")
+	if len(status) < 2 {
+		return "", 0, "", fmt.Errorf("malformed status line %q", trimmed)
+	}
 	httpVer = status[0]
 	statusCodeInt64, err := strconv.ParseInt(status[1], 10, 0)
 	if err != nil {
@@ -94,11 +97,52 @@ func readResponseStatus(reader *bufio.Reader) (
 	return httpVer, statusCode, statusDescription, err
 }
 
+// HasBody reports whether the response can have a body. Responses to HEAD
+// requests and 1xx, 204 and 304 responses never have one.
+func (resp *Response) HasBody() bool {
+	return !resp.noBody && resp.StatusCode >= 200 && resp.StatusCode != 204 &&
+		resp.StatusCode != 304
+}
+
+// OmitBody stops the body of the response from being written as required for
+// responses to HEAD requests. The headers which describe the body are kept.
+func (resp *Response) OmitBody() {
+	resp.noBody = true
+}
+
+// Delimited reports whether the end of the response body can be found without
+// the connection being closed.
+func (resp *Response) Delimited() bool {
+	return !resp.HasBody() || resp.Headers.Chunked() ||
+		resp.Headers.Has("Content-Length")
+}
+
+// KeepAlive reports whether the connection the response was read from can be
+// reused once the body has been read.
+func (resp *Response) KeepAlive() bool {
+	if !resp.Delimited() {
+		return false
+	}
+
+	keepAlive := resp.HTTPVer != "HTTP/1.0"
+	for _, option := range resp.Headers.List("Connection") {
+		if strings.EqualFold(option, "close") {
+			return false
+		}
+		if strings.EqualFold(option, "keep-alive") {
+			keepAlive = true
+		}
+	}
+
+	return keepAlive
+}
+
+// String returns the status line and headers of the response. The reason
+// phrase may be empty.
 func (resp *Response) String() (str string) {
 	var builder strings.Builder
 
-	if resp.HTTPVer == "" || resp.StatusCode == 0 ||
-		resp.StatusDescription == "" {
+	if resp.HTTPVer == "" || resp.StatusCode == 0 {
 		return builder.String()
 	}
 
@@ -109,11 +153,18 @@ func (resp *Response) String() (str string) {
 		resp.StatusCode,
 		resp.StatusDescription,
 	)
-	for k, v := range resp.Headers {
-		fmt.Fprintf(&builder, "%s: %s\r\n", k, v)
-	}
+	writeHeaders(&builder, resp.Headers)
 	fmt.Fprint(&builder, "\r\n")
-	fmt.Fprint(&builder, resp.Body)
 
 	return builder.String()
 }
+
+// WriteTo writes the response message to w, streaming the body if it exists.
+// The number of bytes written is returned.
+func (resp *Response) WriteTo(w io.Writer) (n int64, err error) {
+	if !resp.HasBody() {
+		return writeMessage(w, resp.String(), resp.Headers, nil)
+	}
+
+	return writeMessage(w, resp.String(), resp.Headers, resp.Body)
+}
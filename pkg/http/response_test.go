@@ -0,0 +1,166 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNewResponseBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		method  string
+		body    string
+		err     error
+	}{
+		{
+			name:    "Content-Length",
+			message: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "Content-Length with the next response",
+			message: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloHTTP/1.1 200 OK\r\n",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "Content-Length cut short",
+			message: "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort",
+			method:  "GET",
+			body:    "short",
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "chunked",
+			message: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "chunked cut short",
+			message: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+			method:  "GET",
+			body:    "hel",
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "delimited by the connection closing",
+			message: "HTTP/1.1 200 OK\r\n\r\nhello",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "Content-Length and chunked",
+			message: "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "final transfer coding not chunked",
+			message: "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\nContent-Length: 3\r\n\r\nhello",
+			method:  "GET",
+			body:    "hello",
+		},
+		{
+			name:    "HEAD",
+			message: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			method:  "HEAD",
+		},
+		{
+			name:    "no content",
+			message: "HTTP/1.1 204 No Content\r\n\r\n",
+			method:  "GET",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.message))
+			resp, err := NewResponse(reader, test.method)
+			if err != nil {
+				t.Fatalf("NewResponse() error: %s", err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if string(body) != test.body || err != test.err {
+				t.Errorf("read %q, %v, want %q, %v", body, err, test.body, test.err)
+			}
+		})
+	}
+}
+
+func TestNewResponseFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+	}{
+		{"conflicting Content-Length", "Content-Length: 5\r\nContent-Length: 6\r\n"},
+		{"conflicting Content-Length list", "Content-Length: 5, 6\r\n"},
+		{"negative Content-Length", "Content-Length: -5\r\n"},
+		{"non-numeric Content-Length", "Content-Length: 5 bytes\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := "HTTP/1.1 200 OK\r\n" + test.headers + "\r\nhello!"
+			_, err := NewResponse(bufio.NewReader(strings.NewReader(message)), "GET")
+			if err == nil {
+				t.Errorf("NewResponse() accepted %q", test.headers)
+			}
+		})
+	}
+}
+
+func TestResponseString(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *Response
+		str  string
+	}{
+		{
+			name: "status line and headers",
+			resp: &Response{
+				StatusCode:        200,
+				StatusDescription: "OK",
+				Headers:           Headers{{Name: "Content-Length", Value: "0"}},
+				HTTPVer:           "HTTP/1.1",
+			},
+			str: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name: "empty reason phrase",
+			resp: &Response{StatusCode: 200, HTTPVer: "HTTP/1.1"},
+			str:  "HTTP/1.1 200 \r\n\r\n",
+		},
+		{
+			name: "no status code",
+			resp: &Response{HTTPVer: "HTTP/1.1"},
+			str:  "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if str := test.resp.String(); str != test.str {
+				t.Errorf("String() = %q, want %q", str, test.str)
+			}
+		})
+	}
+}
+
+// TestNewResponseEmptyReason checks that a response with an empty reason
+// phrase is written back out with its status line.
+func TestNewResponseEmptyReason(t *testing.T) {
+	const message = "HTTP/1.1 200 \r\nContent-Length: 0\r\n\r\n"
+	resp, err := NewResponse(bufio.NewReader(strings.NewReader(message)), "GET")
+	if err != nil {
+		t.Fatalf("NewResponse() error: %s", err)
+	}
+	if str := resp.String(); str != message {
+		t.Errorf("String() = %q, want %q", str, message)
+	}
+}
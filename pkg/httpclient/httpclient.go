@@ -1,61 +1,411 @@
 package httpclient
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net"
 	urlpkg "net/url"
+	"sync"
+	"time"
 
 	"github.com/lexesjan/go-web-proxy-server/pkg/http"
 )
 
-// Options represent the options that a request will take.
+// Options represent the options that a request will take. The body is
+// streamed to the host server, the headers must describe its length with
+// Content-Length or a chunked Transfer-Encoding.
 type Options struct {
 	Method  string
-	Headers map[string]string
-	HTTPVer string
+	Headers http.Headers
+	Body    io.Reader
 }
 
-// Request performs a HTTP request to the url specified with the options
+// PoolOptions represent the limits on the connections kept open by a Client.
+type PoolOptions struct {
+	// MaxConnsPerHost limits the number of open connections to a host. Requests
+	// wait for a connection to become available once the limit is reached. A
+	// limit of 0 allows any number of connections.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost limits the number of idle connections kept open to a
+	// host. A limit of 0 allows any number of idle connections.
+	MaxIdleConnsPerHost int
+	// MaxIdleConns limits the total number of idle connections kept open. The
+	// connection which has been idle the longest is closed once the limit is
+	// reached. A limit of 0 allows any number of idle connections.
+	MaxIdleConns int
+	// IdleTimeout is how long an idle connection is kept open. A timeout of 0
+	// keeps idle connections open until the host server closes them.
+	IdleTimeout time.Duration
+}
+
+// Client performs HTTP requests. Connections to host servers are kept open
+// once a response has been read so that they can be reused by later requests
+// to the same host and port.
+type Client struct {
+	options  *PoolOptions
+	mu       sync.Mutex
+	cond     *sync.Cond
+	idle     map[string][]*persistConn
+	numIdle  int
+	numConns map[string]int
+}
+
+// NewClient returns a new Client which pools connections within the limits
 // specified.
-func Request(rawurl string, options *Options) (resp *http.Response, err error) {
-	url, err := urlpkg.Parse(rawurl)
-	if url.Host == "" {
-		return &http.Response{}, fmt.Errorf("%q is not a valid URL", rawurl)
+func NewClient(options *PoolOptions) (client *Client) {
+	client = &Client{
+		options:  options,
+		idle:     make(map[string][]*persistConn),
+		numConns: make(map[string]int),
+	}
+	client.cond = sync.NewCond(&client.mu)
+
+	if options.IdleTimeout > 0 {
+		go client.closeIdleConns()
 	}
+
+	return client
+}
+
+// persistConn is a connection to a host server which can be used for multiple
+// requests.
+type persistConn struct {
+	net.Conn
+	reader *bufio.Reader
+	key    string
+	reused bool
+	idleAt time.Time
+	// peeked receives the result of reading from the connection while it is
+	// idle. Host servers send nothing on an idle connection unless they close
+	// it.
+	peeked chan error
+}
+
+// aLongTimeAgo is a deadline in the past used to interrupt reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Request performs a HTTP request to the url specified with the options
+// specified. An idle connection to the host is used if one is available. The
+// caller must close the body of the response once it is done with it so that
+// the connection can be reused.
+func (client *Client) Request(
+	rawurl string,
+	options *Options,
+) (resp *http.Response, err error) {
+	url, err := urlpkg.Parse(rawurl)
 	if err != nil {
 		return &http.Response{}, err
 	}
+	if url.Host == "" {
+		return &http.Response{}, fmt.Errorf("%q is not a valid URL", rawurl)
+	}
 
 	// Set default hostname and port
 	host := url.Hostname()
-	path := url.Path
-	if path == "" {
-		path = "/"
+	target := url.RequestURI()
+	// A server wide OPTIONS request has no path.
+	if options.Method == "OPTIONS" && url.EscapedPath() == "" &&
+		url.RawQuery == "" {
+		target = "*"
 	}
 	port := url.Port()
 	if port == "" {
 		port = "80"
 	}
 
-	// Initiate TCP connection with host.
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+	headers := options.Headers.Clone()
+	if !headers.Has("Host") {
+		headers.Add("Host", host)
+	}
+	headers.Set("Connection", "keep-alive")
+
+	req := &http.Request{
+		Method:  options.Method,
+		Target:  target,
+		HTTPVer: "HTTP/1.1",
+		Headers: headers,
+		Body:    options.Body,
+	}
+
+	for {
+		pc, err := client.getConn(net.JoinHostPort(host, port))
+		if err != nil {
+			return &http.Response{}, err
+		}
+
+		resp, err = client.roundTrip(pc, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		client.closeConn(pc)
+		// The host server may have closed a pooled connection while the request
+		// was being sent. Only requests which are safe to repeat are retried.
+		if !pc.reused || !idempotent(req) {
+			return &http.Response{}, err
+		}
+	}
+}
+
+func (client *Client) roundTrip(
+	pc *persistConn,
+	req *http.Request,
+) (resp *http.Response, err error) {
+	// Send HTTP request.
+	_, err = req.WriteTo(pc)
 	if err != nil {
 		return &http.Response{}, err
 	}
-	defer conn.Close()
 
-	if _, ok := options.Headers["Host"]; !ok {
-		options.Headers["Host"] = host
+	resp, err = http.NewResponse(pc.reader, req.Method)
+	if err != nil {
+		return &http.Response{}, err
 	}
 
-	req := &http.Request{
-		Method:  options.Method,
-		Path:    path,
-		HTTPVer: options.HTTPVer,
-		Headers: options.Headers,
+	resp.Body = &pooledBody{
+		body:      resp.Body,
+		client:    client,
+		pc:        pc,
+		keepAlive: resp.KeepAlive(),
+		eof:       resp.Body == http.NoBody,
+	}
+
+	return resp, nil
+}
+
+// idempotent reports whether a request can be sent again without side
+// effects. Requests with a body can't be repeated as the body has been read.
+func idempotent(req *http.Request) bool {
+	if req.Body != nil {
+		return false
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+// getConn returns an idle connection to the host if one is available otherwise
+// a new connection is made. It waits for a connection to be released if the
+// host has reached the connection limit.
+func (client *Client) getConn(key string) (pc *persistConn, err error) {
+	client.mu.Lock()
+	for {
+		if idle := client.idle[key]; len(idle) > 0 {
+			pc = idle[len(idle)-1]
+			client.setIdleLocked(key, idle[:len(idle)-1])
+			client.numIdle--
+			client.mu.Unlock()
+
+			// Stop reading from the idle connection. The read only times out if
+			// the host server has not closed the connection.
+			pc.SetReadDeadline(aLongTimeAgo)
+			err = <-pc.peeked
+			pc.SetReadDeadline(time.Time{})
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				pc.reused = true
+				return pc, nil
+			}
+
+			client.closeConn(pc)
+			client.mu.Lock()
+			continue
+		}
+
+		maxConns := client.options.MaxConnsPerHost
+		if maxConns == 0 || client.numConns[key] < maxConns {
+			break
+		}
+		client.cond.Wait()
+	}
+	client.numConns[key]++
+	client.mu.Unlock()
+
+	// Initiate TCP connection with host.
+	conn, err := net.Dial("tcp", key)
+	if err != nil {
+		client.mu.Lock()
+		client.releaseLocked(key)
+		client.mu.Unlock()
+		return &persistConn{}, err
+	}
+
+	pc = &persistConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		key:    key,
+	}
+
+	return pc, nil
+}
+
+// putIdle returns a connection to the pool so that it can be reused.
+func (client *Client) putIdle(pc *persistConn) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	maxIdlePerHost := client.options.MaxIdleConnsPerHost
+	if maxIdlePerHost > 0 && len(client.idle[pc.key]) >= maxIdlePerHost {
+		pc.Close()
+		client.releaseLocked(pc.key)
+		return
+	}
+	maxIdle := client.options.MaxIdleConns
+	if maxIdle > 0 && client.numIdle >= maxIdle {
+		client.closeOldestIdleLocked()
+	}
+
+	pc.idleAt = time.Now()
+	pc.peeked = make(chan error, 1)
+	client.idle[pc.key] = append(client.idle[pc.key], pc)
+	client.numIdle++
+	client.cond.Broadcast()
+
+	go func() {
+		_, err := pc.reader.Peek(1)
+		// The host server closed the connection or sent an unexpected response.
+		if client.removeIdle(pc) {
+			client.closeConn(pc)
+		}
+		pc.peeked <- err
+	}()
+}
+
+// removeIdle removes the connection from the idle connections. It reports
+// whether the connection was idle.
+func (client *Client) removeIdle(pc *persistConn) (removed bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	idle := client.idle[pc.key]
+	for i, idlePC := range idle {
+		if idlePC == pc {
+			client.setIdleLocked(pc.key, append(idle[:i], idle[i+1:]...))
+			client.numIdle--
+			return true
+		}
+	}
+
+	return false
+}
+
+// closeOldestIdleLocked closes the connection which has been idle the longest.
+// The client lock must be held.
+func (client *Client) closeOldestIdleLocked() {
+	var oldest *persistConn
+	oldestIndex := 0
+	for _, idle := range client.idle {
+		for i, pc := range idle {
+			if oldest == nil || pc.idleAt.Before(oldest.idleAt) {
+				oldest = pc
+				oldestIndex = i
+			}
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	idle := client.idle[oldest.key]
+	client.setIdleLocked(
+		oldest.key,
+		append(idle[:oldestIndex], idle[oldestIndex+1:]...),
+	)
+	client.numIdle--
+	oldest.Close()
+	client.releaseLocked(oldest.key)
+}
+
+// closeIdleConns periodically closes connections which have been idle for
+// longer than the idle timeout.
+func (client *Client) closeIdleConns() {
+	ticker := time.NewTicker(client.options.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		client.mu.Lock()
+		for key, idle := range client.idle {
+			kept := idle[:0]
+			for _, pc := range idle {
+				if time.Since(pc.idleAt) < client.options.IdleTimeout {
+					kept = append(kept, pc)
+					continue
+				}
+				client.numIdle--
+				pc.Close()
+				client.releaseLocked(key)
+			}
+			client.setIdleLocked(key, kept)
+		}
+		client.mu.Unlock()
+	}
+}
+
+// setIdleLocked replaces the idle connections to the host. The client lock must
+// be held.
+func (client *Client) setIdleLocked(key string, idle []*persistConn) {
+	if len(idle) == 0 {
+		delete(client.idle, key)
+		return
+	}
+	client.idle[key] = idle
+}
+
+// closeConn closes a connection which is not idle.
+func (client *Client) closeConn(pc *persistConn) {
+	pc.Close()
+
+	client.mu.Lock()
+	client.releaseLocked(pc.key)
+	client.mu.Unlock()
+}
+
+// releaseLocked frees a connection slot for the host and wakes any requests
+// waiting for one. The client lock must be held.
+func (client *Client) releaseLocked(key string) {
+	client.numConns[key]--
+	if client.numConns[key] <= 0 {
+		delete(client.numConns, key)
+	}
+	client.cond.Broadcast()
+}
+
+// pooledBody is the body of a response read from a pooled connection. Closing
+// the body returns the connection to the pool if the body was read in full
+// otherwise the connection is closed.
+type pooledBody struct {
+	body      io.ReadCloser
+	client    *Client
+	pc        *persistConn
+	keepAlive bool
+	eof       bool
+	closed    bool
+}
+
+func (pooledBody *pooledBody) Read(p []byte) (n int, err error) {
+	n, err = pooledBody.body.Read(p)
+	if err == io.EOF {
+		pooledBody.eof = true
+	}
+
+	return n, err
+}
+
+func (pooledBody *pooledBody) Close() (err error) {
+	if pooledBody.closed {
+		return nil
+	}
+	pooledBody.closed = true
+
+	if pooledBody.eof && pooledBody.keepAlive {
+		pooledBody.client.putIdle(pooledBody.pc)
+	} else {
+		pooledBody.client.closeConn(pooledBody.pc)
 	}
-	// Send HTTP request.
-	fmt.Fprint(conn, req)
 
-	return http.NewResponse(conn)
+	return nil
 }
@@ -0,0 +1,278 @@
+package httpclient
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lexesjan/go-web-proxy-server/pkg/http"
+)
+
+// testServer is a host server on a local listener which answers requests with
+// the body "ok" and closes connections once they have answered closeAfter
+// requests.
+type testServer struct {
+	listener net.Listener
+	// closeAfter closes each connection without a response once it has
+	// answered that many requests. 0 answers every request.
+	closeAfter int
+	// hangUp closes the connection as soon as the last request is answered
+	// rather than once the next request arrives.
+	hangUp bool
+
+	mu       sync.Mutex
+	conns    int
+	requests []string
+}
+
+func newTestServer(t *testing.T, closeAfter int, hangUp bool) (server *testServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = &testServer{listener: listener, closeAfter: closeAfter, hangUp: hangUp}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+
+	return server
+}
+
+func (server *testServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.conns++
+		server.mu.Unlock()
+		go server.serveConn(conn)
+	}
+}
+
+func (server *testServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for answered := 0; ; answered++ {
+		req, err := http.NewRequest(reader)
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.requests = append(server.requests, req.Method)
+		server.mu.Unlock()
+		if server.closeAfter > 0 && answered >= server.closeAfter {
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		if server.hangUp && answered+1 >= server.closeAfter {
+			return
+		}
+	}
+}
+
+func (server *testServer) url() string {
+	return "http://" + server.listener.Addr().String() + "/"
+}
+
+// stats returns the number of connections accepted and the methods of the
+// requests received.
+func (server *testServer) stats() (conns int, requests []string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.conns, append([]string{}, server.requests...)
+}
+
+// get sends a request and reads the whole body of the response.
+func get(t *testing.T, client *Client, url string, method string) (err error) {
+	resp, err := client.Request(url, &Options{Method: method, Headers: http.Headers{}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if string(body) != "ok" {
+		t.Errorf("read body %q, want %q", body, "ok")
+	}
+
+	return nil
+}
+
+// numIdleConns returns the number of idle connections in the pool.
+func (client *Client) numIdleConns() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.numIdle
+}
+
+func TestClientReusesConnection(t *testing.T) {
+	server := newTestServer(t, 0, false)
+	client := NewClient(&PoolOptions{})
+
+	for i := 0; i < 3; i++ {
+		if err := get(t, client, server.url(), "GET"); err != nil {
+			t.Fatalf("request %d error: %s", i, err)
+		}
+	}
+	if conns, _ := server.stats(); conns != 1 {
+		t.Errorf("server accepted %d connections, want 1", conns)
+	}
+}
+
+// TestClientRetriesStaleConnection checks that a request which fails on a
+// pooled connection the host server closed is retried only if it can be
+// repeated.
+func TestClientRetriesStaleConnection(t *testing.T) {
+	tests := []struct {
+		method   string
+		retried  bool
+		requests []string
+	}{
+		{"GET", true, []string{"GET", "GET", "GET"}},
+		{"POST", false, []string{"POST", "POST"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			// The server closes each connection instead of answering a second
+			// request so that the pooled connection fails once it is used.
+			server := newTestServer(t, 1, false)
+			client := NewClient(&PoolOptions{})
+
+			if err := get(t, client, server.url(), test.method); err != nil {
+				t.Fatalf("first request error: %s", err)
+			}
+			err := get(t, client, server.url(), test.method)
+			if test.retried && err != nil {
+				t.Errorf("second request error: %s", err)
+			}
+			if !test.retried && err == nil {
+				t.Error("second request was retried")
+			}
+			conns, requests := server.stats()
+			wantConns := len(test.requests) - 1
+			if conns != wantConns || fmt.Sprint(requests) != fmt.Sprint(test.requests) {
+				t.Errorf(
+					"server accepted %d connections for %q, want %d for %q",
+					conns,
+					requests,
+					wantConns,
+					test.requests,
+				)
+			}
+		})
+	}
+}
+
+// TestClientDropsClosedIdleConnection checks that a pooled connection which the
+// host server closes while it is idle is not used again, even for a request
+// which can't be retried.
+func TestClientDropsClosedIdleConnection(t *testing.T) {
+	server := newTestServer(t, 1, true)
+	client := NewClient(&PoolOptions{})
+
+	if err := get(t, client, server.url(), "POST"); err != nil {
+		t.Fatalf("first request error: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.numIdleConns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still pooled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := get(t, client, server.url(), "POST"); err != nil {
+		t.Fatalf("second request error: %s", err)
+	}
+	if conns, _ := server.stats(); conns != 2 {
+		t.Errorf("server accepted %d connections, want 2", conns)
+	}
+}
+
+// TestClientMaxConnsPerHost checks that a request waits while the host has the
+// most connections allowed open.
+func TestClientMaxConnsPerHost(t *testing.T) {
+	server := newTestServer(t, 0, false)
+	client := NewClient(&PoolOptions{MaxConnsPerHost: 1})
+
+	first, err := client.Request(server.url(), &Options{Method: "GET", Headers: http.Headers{}})
+	if err != nil {
+		t.Fatalf("first request error: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- get(t, client, server.url(), "GET")
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("second request finished with %v while the first was open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ioutil.ReadAll(first.Body)
+	first.Body.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("second request error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second request still waiting once the first was closed")
+	}
+	if conns, _ := server.stats(); conns != 1 {
+		t.Errorf("server accepted %d connections, want 1", conns)
+	}
+}
+
+func TestClientIdleLimits(t *testing.T) {
+	server := newTestServer(t, 0, false)
+	client := NewClient(&PoolOptions{MaxIdleConnsPerHost: 1})
+
+	// Hold two connections open at once so that both are returned to the pool.
+	resps := []*http.Response{}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Request(server.url(), &Options{Method: "GET", Headers: http.Headers{}})
+		if err != nil {
+			t.Fatalf("request %d error: %s", i, err)
+		}
+		resps = append(resps, resp)
+	}
+	for _, resp := range resps {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if numIdle := client.numIdleConns(); numIdle != 1 {
+		t.Errorf("pool keeps %d idle connections, want 1", numIdle)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	server := newTestServer(t, 0, false)
+	client := NewClient(&PoolOptions{IdleTimeout: 20 * time.Millisecond})
+
+	if err := get(t, client, server.url(), "GET"); err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if numIdle := client.numIdleConns(); numIdle != 1 {
+		t.Fatalf("pool keeps %d idle connections, want 1", numIdle)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.numIdleConns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection still pooled after the idle timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
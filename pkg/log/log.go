@@ -61,13 +61,18 @@ func ProxyError(err error) {
 	))
 }
 
-// ProxyHTTPResponse logs a proxy HTTP response
-func ProxyHTTPResponse(req *http.Request, resp *http.Response, time time.Duration, cached bool) {
+// ProxyHTTPResponse logs a proxy HTTP response. The bandwidth is the number of
+// bytes received from the host server.
+func ProxyHTTPResponse(
+	req *http.Request,
+	resp *http.Response,
+	bandwidth int64,
+	time time.Duration,
+	cached bool,
+) {
 	method := req.Method
-	host := req.Headers["Host"]
-	reqURL := fmt.Sprintf("http://%s%s", host, req.Path)
+	reqURL := req.URL()
 	httpVersion := resp.HTTPVer
-	bandwidth := len(resp.String())
 	proxy(
 		"HTTP",
 		"Response",
@@ -87,7 +92,7 @@ func ProxyHTTPResponse(req *http.Request, resp *http.Response, time time.Duratio
 // ProxyHTTPSRequest logs a proxy HTTPS request
 func ProxyHTTPSRequest(req *http.Request) {
 	method := req.Method
-	host := req.Headers["Host"]
+	host := req.Target
 	httpVersion := req.HTTPVer
 	proxy(
 		"HTTPS",
@@ -171,3 +176,137 @@ func ProxyCacheStale(requestURL string) {
 		requestURL,
 	))
 }
+
+// ProxyCacheRemove logs a stale cache entry which was removed as it can no
+// longer be served and the number of bytes freed
+func ProxyCacheRemove(requestURL string, size int64) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Remove%s%s]%s [Request URL: %q] [Size: %d bytes]\n",
+		ansi.LightRed,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightRed,
+		ansi.Reset,
+		requestURL,
+		size,
+	))
+}
+
+// ProxyCacheServeStale logs a stale cache entry served to the client and the
+// reason it was served
+func ProxyCacheServeStale(requestURL string, reason string) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Serve Stale%s%s]%s [Request URL: %q] [Reason: %q]\n",
+		ansi.Magenta,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.Magenta,
+		ansi.Reset,
+		requestURL,
+		reason,
+	))
+}
+
+// ProxyCacheSkip logs a response which was not cached and the reason it was
+// not cached
+func ProxyCacheSkip(requestURL string, reason string) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Skip%s%s]%s [Request URL: %q] [Reason: %q]\n",
+		ansi.LightBlack,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightBlack,
+		ansi.Reset,
+		requestURL,
+		reason,
+	))
+}
+
+// ProxyCacheInvalidate logs the cached responses of a URL removed after a
+// request with an unsafe method
+func ProxyCacheInvalidate(requestURL string, method string) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Invalidate%s%s]%s [Request URL: %q] [Method: %q]\n",
+		ansi.LightRed,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightRed,
+		ansi.Reset,
+		requestURL,
+		method,
+	))
+}
+
+// ProxyCachePurge logs the number and size of the cached responses of a URL
+// removed by a purge
+func ProxyCachePurge(requestURL string, entries int, size int64) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Purge%s%s]%s [Request URL: %q] [Entries: %d] [Size: %d bytes]\n",
+		ansi.LightRed,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightRed,
+		ansi.Reset,
+		requestURL,
+		entries,
+		size,
+	))
+}
+
+// ProxyCacheCoalesce logs a response shared with another request for the same
+// URL which was already being fetched from the host server
+func ProxyCacheCoalesce(requestURL string) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Coalesce%s%s]%s [Request URL: %q]\n",
+		ansi.LightCyan,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightCyan,
+		ansi.Reset,
+		requestURL,
+	))
+}
+
+// ProxyCacheRule logs a cache rule applied to the response of a URL
+func ProxyCacheRule(requestURL string, rule string) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Rule%s%s]%s [Request URL: %q] [Rule: %q]\n",
+		ansi.Yellow,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.Yellow,
+		ansi.Reset,
+		requestURL,
+		rule,
+	))
+}
+
+// ProxyCacheRevalidate logs the validators sent to the host server to
+// revalidate a stale cache entry and the status code of the response
+func ProxyCacheRevalidate(
+	requestURL string,
+	ifNoneMatch string,
+	ifModifiedSince string,
+	statusCode int,
+) {
+	logger.output(fmt.Sprintf(
+		"%s[%s%sCache Revalidate%s%s]%s [Request URL: %q] [If-None-Match: %q] [If-Modified-Since: %q] [Status Code: %d]\n",
+		ansi.LightCyan,
+		ansi.Reset,
+		Bold,
+		ansi.Reset,
+		ansi.LightCyan,
+		ansi.Reset,
+		requestURL,
+		ifNoneMatch,
+		ifModifiedSince,
+		statusCode,
+	))
+}
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lexesjan/go-web-proxy-server/pkg/cache"
@@ -12,8 +13,16 @@ import (
 
 // Metrics represents the metrics stored for the proxy
 type Metrics struct {
-	timeSaved      *sync.Map
-	bandwidthSaved *sync.Map
+	// The eviction, coalesced and not modified counters are accessed atomically
+	// so they come first to be 64-bit aligned.
+	evictions        int64
+	evictedBytes     int64
+	coalesced        int64
+	coalescedBytes   int64
+	notModified      int64
+	notModifiedBytes int64
+	timeSaved        *sync.Map
+	bandwidthSaved   *sync.Map
 }
 
 // NewMetrics returns a new Metrics struct
@@ -89,6 +98,32 @@ func (metrics *Metrics) AddMetrics(
 	metrics.addBandwidthSaved(reqURL, bandwidthSaved)
 }
 
+// AddEviction counts a response evicted from the cache to make room for other
+// responses
+func (metrics *Metrics) AddEviction(reqURL string, cacheEntry *cache.Entry) {
+	atomic.AddInt64(&metrics.evictions, 1)
+	atomic.AddInt64(&metrics.evictedBytes, cacheEntry.Size())
+}
+
+// AddCoalesced counts a response shared with another request for the same URL.
+// The bytes sent to the client are added to the bandwidth saved
+func (metrics *Metrics) AddCoalesced(reqURL string, bandwidthSaved int64) {
+	atomic.AddInt64(&metrics.coalesced, 1)
+	atomic.AddInt64(&metrics.coalescedBytes, bandwidthSaved)
+	metrics.addBandwidthSaved(reqURL, bandwidthSaved)
+}
+
+// AddNotModified counts a 304 Not Modified response sent in place of a cached
+// response and the bytes of the cached response not sent. They are kept apart
+// from the bandwidth saved which already counts the request as a cache hit
+func (metrics *Metrics) AddNotModified(reqURL string, bytesNotSent int64) {
+	if bytesNotSent < 0 {
+		bytesNotSent = 0
+	}
+	atomic.AddInt64(&metrics.notModified, 1)
+	atomic.AddInt64(&metrics.notModifiedBytes, bytesNotSent)
+}
+
 func (metrics *Metrics) String() string {
 	var builder strings.Builder
 
@@ -131,6 +166,15 @@ func (metrics *Metrics) String() string {
 		prefix = "   "
 		return true
 	})
+	fmt.Fprintf(&builder, "%sevictions:\n", prefix)
+	fmt.Fprintf(&builder, "%s - entries: %v\n", prefix, atomic.LoadInt64(&metrics.evictions))
+	fmt.Fprintf(&builder, "%s - size: %v bytes\n", prefix, atomic.LoadInt64(&metrics.evictedBytes))
+	fmt.Fprintf(&builder, "%scoalesced:\n", prefix)
+	fmt.Fprintf(&builder, "%s - requests: %v\n", prefix, atomic.LoadInt64(&metrics.coalesced))
+	fmt.Fprintf(&builder, "%s - size: %v bytes\n", prefix, atomic.LoadInt64(&metrics.coalescedBytes))
+	fmt.Fprintf(&builder, "%snot modified:\n", prefix)
+	fmt.Fprintf(&builder, "%s - requests: %v\n", prefix, atomic.LoadInt64(&metrics.notModified))
+	fmt.Fprintf(&builder, "%s - size: %v bytes\n", prefix, atomic.LoadInt64(&metrics.notModifiedBytes))
 
 	return strings.TrimRight(builder.String(), "\n")
 }
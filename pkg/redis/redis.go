@@ -0,0 +1,231 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleConns is the number of idle connections kept open to the server.
+const maxIdleConns = 8
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// Client sends commands to a key-value server which speaks the Redis protocol
+// (RESP). Connections are kept open once a reply has been read so that they
+// can be reused by later commands.
+type Client struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	idle    []*conn
+}
+
+// NewClient returns a new Client which connects to the server at the address
+// specified. Connecting to the server and each command must finish within the
+// timeout so that a server which stops answering does not hold up the callers
+// forever. A timeout of 0 waits forever.
+func NewClient(addr string, timeout time.Duration) (client *Client) {
+	return &Client{addr: addr, timeout: timeout, idle: []*conn{}}
+}
+
+// conn is a connection to the server.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	reused bool
+}
+
+// Do sends a command to the server and returns the reply. The arguments may be
+// strings, byte slices or integers. The reply is a string for status replies,
+// an int64 for integer replies, a byte slice for bulk string replies and a
+// slice of replies for array replies. Null replies are nil. Error replies are
+// returned as an Error. A command which fails on a connection kept open from
+// an earlier command is sent once more on a new connection as the server may
+// have closed the connection, for example when it restarted. Commands which
+// time out are not sent again.
+func (client *Client) Do(args ...interface{}) (reply interface{}, err error) {
+	reply, reused, err := client.do(args, false)
+	if reused && err != nil {
+		_, isError := err.(Error)
+		netErr, isNetErr := err.(net.Error)
+		if !isError && !(isNetErr && netErr.Timeout()) {
+			reply, _, err = client.do(args, true)
+		}
+	}
+
+	return reply, err
+}
+
+// do sends a command on an idle connection, or a new one if fresh is set or no
+// connection is idle. The reused result reports whether an idle connection was
+// used.
+func (client *Client) do(
+	args []interface{},
+	fresh bool,
+) (reply interface{}, reused bool, err error) {
+	conn, err := client.getConn(fresh)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if client.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(client.timeout))
+	}
+	err = writeCommand(conn.writer, args)
+	if err == nil {
+		reply, err = readReply(conn.reader)
+	}
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection is out of sync with the server.
+		conn.Close()
+		return nil, conn.reused, err
+	}
+	client.putIdle(conn)
+
+	return reply, conn.reused, err
+}
+
+// getConn returns an idle connection if one is available otherwise a new
+// connection is made. A new connection is always made if fresh is set.
+func (client *Client) getConn(fresh bool) (c *conn, err error) {
+	client.mu.Lock()
+	if len(client.idle) > 0 && !fresh {
+		c = client.idle[len(client.idle)-1]
+		client.idle = client.idle[:len(client.idle)-1]
+		client.mu.Unlock()
+		c.reused = true
+		return c, nil
+	}
+	client.mu.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", client.addr, client.timeout)
+	if err != nil {
+		return &conn{}, err
+	}
+
+	c = &conn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+
+	return c, nil
+}
+
+// putIdle keeps the connection open for reuse.
+func (client *Client) putIdle(c *conn) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if len(client.idle) >= maxIdleConns {
+		c.Close()
+		return
+	}
+	client.idle = append(client.idle, c)
+}
+
+// writeCommand writes the command as an array of bulk strings.
+func writeCommand(writer *bufio.Writer, args []interface{}) (err error) {
+	fmt.Fprintf(writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var value []byte
+		switch arg := arg.(type) {
+		case string:
+			value = []byte(arg)
+		case []byte:
+			value = arg
+		case int:
+			value = []byte(strconv.Itoa(arg))
+		case int64:
+			value = []byte(strconv.FormatInt(arg, 10))
+		default:
+			return fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		fmt.Fprintf(writer, "$%d\r\n", len(value))
+		writer.Write(value)
+		writer.WriteString("\r\n")
+	}
+
+	return writer.Flush()
+}
+
+// readLine reads a line without the CRLF ending.
+func readLine(reader *bufio.Reader) (line string, err error) {
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply line %q", line)
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply sent by the server.
+func readReply(reader *bufio.Reader) (reply interface{}, err error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		// Read the CRLF which follows the bulk string as well.
+		value := make([]byte, length+2)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			values[i], err = readReply(reader)
+			// Error replies inside an array are kept as values.
+			if _, ok := err.(Error); ok {
+				values[i], err = err, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer answers each command with +OK until a connection has answered
+// closeAfter commands. The connection is then closed, or if hang is set the
+// commands are read without ever being answered.
+type testServer struct {
+	listener   net.Listener
+	closeAfter int
+	hang       bool
+
+	mu       sync.Mutex
+	conns    int
+	commands int
+}
+
+func newTestServer(t *testing.T, closeAfter int, hang bool) (server *testServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = &testServer{listener: listener, closeAfter: closeAfter, hang: hang}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+
+	return server
+}
+
+func (server *testServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.conns++
+		server.mu.Unlock()
+		go server.serveConn(conn)
+	}
+}
+
+func (server *testServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for answered := 0; ; answered++ {
+		_, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.commands++
+		server.mu.Unlock()
+		if server.closeAfter > 0 && answered >= server.closeAfter {
+			if server.hang {
+				continue
+			}
+			return
+		}
+		fmt.Fprint(conn, "+OK\r\n")
+	}
+}
+
+// stats returns the number of connections accepted and commands received.
+func (server *testServer) stats() (conns int, commands int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.conns, server.commands
+}
+
+func TestClientReusesConnection(t *testing.T) {
+	server := newTestServer(t, 0, false)
+	client := NewClient(server.listener.Addr().String(), time.Second)
+
+	for i := 0; i < 3; i++ {
+		reply, err := client.Do("SET", "key", i)
+		if err != nil || reply != "OK" {
+			t.Fatalf("Do() = %v, %v, want OK", reply, err)
+		}
+	}
+	if conns, _ := server.stats(); conns != 1 {
+		t.Errorf("server accepted %d connections, want 1", conns)
+	}
+}
+
+// TestClientRetriesClosedConnection checks that a command which fails on a
+// connection the server closed is sent again on a new connection.
+func TestClientRetriesClosedConnection(t *testing.T) {
+	server := newTestServer(t, 1, false)
+	client := NewClient(server.listener.Addr().String(), time.Second)
+
+	for i := 0; i < 2; i++ {
+		reply, err := client.Do("GET", "key")
+		if err != nil || reply != "OK" {
+			t.Fatalf("Do() = %v, %v, want OK", reply, err)
+		}
+	}
+	if conns, commands := server.stats(); conns != 2 || commands != 3 {
+		t.Errorf("server got %d commands on %d connections, want 3 on 2", commands, conns)
+	}
+}
+
+// TestClientTimeout checks that a command sent to a server which stops
+// answering fails once the timeout passes and is not sent again.
+func TestClientTimeout(t *testing.T) {
+	server := newTestServer(t, 1, true)
+	client := NewClient(server.listener.Addr().String(), 50*time.Millisecond)
+
+	if _, err := client.Do("GET", "key"); err != nil {
+		t.Fatalf("Do() error: %s", err)
+	}
+	start := time.Now()
+	_, err := client.Do("GET", "key")
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("Do() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do() took %s, want about 50ms", elapsed)
+	}
+	if conns, commands := server.stats(); conns != 1 || commands != 2 {
+		t.Errorf("server got %d commands on %d connections, want 2 on 1", commands, conns)
+	}
+}